@@ -0,0 +1,123 @@
+package caddy_logger_loki
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Backends the writer can push to.
+const (
+	backendLoki         = "loki"
+	backendGrafanaCloud = "grafana_cloud"
+	backendVictoriaLogs = "victorialogs"
+)
+
+// backendProfile describes how a Loki-compatible backend differs from Loki itself.
+type backendProfile struct {
+	// push paths appended to a url without path, by protocol
+	pushPaths map[string]string
+
+	// readyPath is the readiness endpoint probed by verify_on_start, relative to the base url.
+	readyPath string
+
+	// acceptsQuery is set if the backend reads parameters from the query string of the push url.
+	acceptsQuery bool
+
+	// tenantHeaders converts the tenant id into request headers, nil means Loki's X-Scope-OrgID header is used.
+	tenantHeaders func(tenantID string) (map[string]string, error)
+
+	// warnings returns a warning for every setting of l the backend ignores or is likely misconfigured.
+	warnings func(l *LokiLog) []string
+}
+
+var backends = map[string]backendProfile{
+	backendLoki: {
+		pushPaths: map[string]string{
+			protocolLoki: "/loki/api/v1/push",
+			protocolOTLP: "/otlp/v1/logs",
+		},
+		readyPath: "/ready",
+	},
+	backendGrafanaCloud: {
+		pushPaths: map[string]string{
+			protocolLoki: "/loki/api/v1/push",
+			protocolOTLP: "/otlp/v1/logs",
+		},
+		warnings: func(l *LokiLog) []string {
+			var warnings []string
+			if l.TenantId != "" {
+				warnings = append(warnings, "tenant_id is ignored by grafana_cloud, the tenant is the instance id used as basic_auth username")
+			}
+			if l.BasicAuth == nil {
+				warnings = append(warnings, "grafana_cloud requires basic_auth with the instance id as username and an access policy token as password")
+			}
+			return warnings
+		},
+	},
+	backendVictoriaLogs: {
+		pushPaths: map[string]string{
+			protocolLoki: "/insert/loki/api/v1/push",
+			protocolOTLP: "/insert/opentelemetry/v1/logs",
+		},
+		readyPath: "/health",
+		// e.g. _stream_fields, _msg_field and _time_field
+		acceptsQuery:  true,
+		tenantHeaders: victoriaLogsTenantHeaders,
+		warnings: func(l *LokiLog) []string {
+			var warnings []string
+			if l.DropRateLimitedBatches {
+				warnings = append(warnings, "drop_rate_limited_batches has no effect with victorialogs, it doesn't rate limit pushes")
+			}
+			for k := range l.Labels {
+				if k == "__tenant_id__" {
+					warnings = append(warnings, "the __tenant_id__ label is ignored by victorialogs, use tenant_id instead")
+				}
+			}
+			return warnings
+		},
+	},
+}
+
+/*
+victoriaLogsTenantHeaders converts a tenant id written as <AccountID>[:<ProjectID>] into the AccountID and
+ProjectID headers, VictoriaLogs ignores X-Scope-OrgID.
+*/
+func victoriaLogsTenantHeaders(tenantID string) (map[string]string, error) {
+	accountID, projectID, _ := strings.Cut(tenantID, ":")
+	if projectID == "" {
+		projectID = "0"
+	}
+	for _, id := range []string{accountID, projectID} {
+		if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+			return nil, fmt.Errorf("tenant_id %q is invalid for victorialogs, it must be written as <AccountID>[:<ProjectID>] with numeric ids", tenantID)
+		}
+	}
+	return map[string]string{
+		"AccountID": accountID,
+		"ProjectID": projectID,
+	}, nil
+}
+
+// completePushPath appends the push path of the backend to u if it has no path.
+func (b backendProfile) completePushPath(u *url.URL, protocol string) *url.URL {
+	if u.Path != "" && u.Path != "/" {
+		return u
+	}
+	completed := *u
+	completed.Path = b.pushPaths[protocol]
+	return &completed
+}
+
+/*
+readyURL returns the readiness endpoint for the push url u. A push path of the backend is stripped first, so a
+Loki behind a path prefix like http://gateway/loki-a/loki/api/v1/push is probed at http://gateway/loki-a/ready.
+*/
+func (b backendProfile) readyURL(u *url.URL, protocol string) *url.URL {
+	ready := *u
+	ready.RawQuery = ""
+	ready.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, b.pushPaths[protocol]), "/") + b.readyPath
+	ready.RawPath = ""
+	return &ready
+}
@@ -0,0 +1,81 @@
+package caddy_logger_loki
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func TestBackendVictoriaLogs(t *testing.T) {
+	s := &testServer{}
+	l := LokiLog{
+		Url:      s.start(t),
+		Backend:  "victorialogs",
+		TenantId: "12:34",
+		Labels:   map[string]string{"job": "caddy"},
+	}
+	pushLines(t, &l, `{"msg":"hello"}`)
+	push := s.first(t)
+
+	if push.path != "/insert/loki/api/v1/push" {
+		t.Fatalf("expected push path /insert/loki/api/v1/push, got %q", push.path)
+	}
+	if push.header.Get("AccountID") != "12" || push.header.Get("ProjectID") != "34" {
+		t.Fatalf("unexpected tenant headers AccountID=%q ProjectID=%q", push.header.Get("AccountID"), push.header.Get("ProjectID"))
+	}
+	if push.header.Get("X-Scope-OrgID") != "" {
+		t.Fatalf("X-Scope-OrgID must not be sent to victorialogs")
+	}
+
+	l = LokiLog{Url: s.start(t), Backend: "victorialogs", TenantId: "team-a", Labels: map[string]string{"job": "caddy"}}
+	l.logger = newLogger(zap.NewNop())
+	if err := l.Validate(); err == nil {
+		t.Fatalf("expected error for non numeric victorialogs tenant")
+	}
+}
+
+func TestBackendPushPath(t *testing.T) {
+	tests := []struct {
+		url      string
+		backend  string
+		protocol string
+		expected string
+	}{
+		{"http://loki:3100", "", "", "http://loki:3100/loki/api/v1/push"},
+		{"http://loki:3100/", "loki", "otlp", "http://loki:3100/otlp/v1/logs"},
+		{"http://loki:3100/custom/push", "loki", "", "http://loki:3100/custom/push"},
+		{"http://victorialogs:9428", "victorialogs", "otlp", "http://victorialogs:9428/insert/opentelemetry/v1/logs"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			l := LokiLog{Url: test.url, Backend: test.backend, Protocol: test.protocol, Labels: map[string]string{"job": "caddy"}}
+			l.logger = newLogger(zap.NewNop())
+			if err := l.Validate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if l.clientConfig.URL.String() != test.expected {
+				t.Fatalf("expected url %q, got %q", test.expected, l.clientConfig.URL.String())
+			}
+		})
+	}
+}
+
+func TestBackendWarnings(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	l := LokiLog{Url: "https://logs.grafana.net", Backend: "grafana_cloud", TenantId: "1", Labels: map[string]string{"job": "caddy"}}
+	l.logger = newLogger(zap.New(core))
+	if err := l.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// tenant_id is ignored and basic_auth is missing
+	if logs.Len() != 2 {
+		t.Fatalf("expected 2 warnings, got %v", logs.All())
+	}
+
+	l = LokiLog{Url: "http://loki:3100", Backend: "elasticsearch", Labels: map[string]string{"job": "caddy"}}
+	if err := l.Validate(); err == nil {
+		t.Fatalf("expected error for unknown backend")
+	}
+}
@@ -0,0 +1,101 @@
+package caddy_logger_loki
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// backoffConfig configures the retries of a failed push request.
+type backoffConfig struct {
+	// delay before the first retry, doubled for every following retry
+	MinBackoff time.Duration
+	// upper bound of the delay between retries
+	MaxBackoff time.Duration
+	// maximum number of attempts, 0 means retrying until the context is canceled
+	MaxRetries int
+	// fraction the delays are randomized by, e.g. 0.2 spreads a delay of 10s over 8s to 12s
+	Jitter float64
+	// maximum total time spent retrying, 0 means no limit
+	MaxElapsed time.Duration
+}
+
+// backoff implements exponential backoff between the retries of a single push request.
+type backoff struct {
+	cfg        backoffConfig
+	ctx        context.Context
+	start      time.Time
+	numRetries int
+	nextDelay  time.Duration
+	// set when the next delay would exceed max_elapsed
+	exhausted bool
+
+	// returns a random number in [0, 1), for the jitter
+	random func() float64
+}
+
+func newBackoff(ctx context.Context, cfg backoffConfig) *backoff {
+	return &backoff{
+		cfg:       cfg,
+		ctx:       ctx,
+		start:     time.Now(),
+		nextDelay: cfg.MinBackoff,
+		random:    rand.Float64,
+	}
+}
+
+// ongoing reports whether another attempt should be made.
+func (b *backoff) ongoing() bool {
+	return b.ctx.Err() == nil && !b.exhausted && (b.cfg.MaxRetries == 0 || b.numRetries < b.cfg.MaxRetries)
+}
+
+// wait sleeps for the next delay, unless the retries are exhausted or the context is canceled.
+func (b *backoff) wait(retryAfter time.Duration) {
+	delay := b.next(retryAfter)
+	if !b.ongoing() {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-b.ctx.Done():
+	case <-timer.C:
+	}
+}
+
+/*
+next counts a retry and returns the delay before it, the retries are exhausted if it would exceed max_elapsed. A
+positive retryAfter, as requested by the server, replaces the computed delay. It is limited to max_period and the time
+left of max_elapsed, so a server can't stall the worker, and the writes waiting for its queue, for longer.
+*/
+func (b *backoff) next(retryAfter time.Duration) time.Duration {
+	delay := b.delay()
+	if retryAfter > 0 {
+		delay = min(retryAfter, b.cfg.MaxBackoff)
+	}
+	if b.cfg.MaxElapsed > 0 {
+		left := b.cfg.MaxElapsed - time.Since(b.start)
+		if retryAfter > 0 && delay > left {
+			delay = left
+		}
+		if delay > left || left <= 0 {
+			b.exhausted = true
+		}
+	}
+	return delay
+}
+
+// delay counts a retry and returns the delay before it.
+func (b *backoff) delay() time.Duration {
+	b.numRetries++
+	delay := b.nextDelay
+	if delay >= b.cfg.MaxBackoff {
+		delay = b.cfg.MaxBackoff
+	} else {
+		b.nextDelay = 2 * delay
+	}
+	if b.cfg.Jitter > 0 {
+		delay += time.Duration(float64(delay) * b.cfg.Jitter * (2*b.random() - 1))
+	}
+	return delay
+}
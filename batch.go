@@ -0,0 +1,167 @@
+package caddy_logger_loki
+
+import (
+	"fmt"
+	"github.com/grafana/loki/pkg/push"
+	"github.com/prometheus/common/model"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reservedLabelTenantID is a label which overrides the tenant of an entry, it isn't sent as stream label.
+const reservedLabelTenantID = "__tenant_id__"
+
+/*
+entry is a log line with the labels of its stream. The labels are shared by the entries of a writer, so they must
+not be modified.
+*/
+type entry struct {
+	labels model.LabelSet
+	// the labels formatted by labelsString, set by client.handle if empty
+	stream string
+	push.Entry
+}
+
+// pushStream returns a stream with only e.
+func (e entry) pushStream() push.Stream {
+	return push.Stream{Labels: e.stream, Entries: []push.Entry{e.Entry}}
+}
+
+// errMaxStreamsLimitExceeded is returned when an entry would add a stream to a batch which has max_streams streams.
+type errMaxStreamsLimitExceeded struct {
+	streams, limit int
+	labels         string
+}
+
+func (e errMaxStreamsLimitExceeded) Error() string {
+	return fmt.Sprintf("streams limit exceeded, streams: %d exceeds limit: %d, stream: '%s'", e.streams, e.limit, e.labels)
+}
+
+/*
+batch holds the streams of a tenant waiting to be pushed, so entries are sent in as few requests as possible.
+*/
+type batch struct {
+	streams   map[string]*push.Stream
+	bytes     int
+	createdAt time.Time
+
+	maxStreams int
+}
+
+func newBatch(maxStreams int, entries ...entry) *batch {
+	b := &batch{
+		streams:    map[string]*push.Stream{},
+		createdAt:  time.Now(),
+		maxStreams: maxStreams,
+	}
+	for _, e := range entries {
+		// a new batch has no streams, so this never fails
+		_ = b.add(e)
+	}
+	return b
+}
+
+// add appends e to the stream of its labels.
+func (b *batch) add(e entry) error {
+	labels := e.stream
+	if stream, ok := b.streams[labels]; ok {
+		stream.Entries = append(stream.Entries, e.Entry)
+		b.bytes += entrySize(e)
+		return nil
+	}
+
+	if b.maxStreams > 0 && len(b.streams) >= b.maxStreams {
+		return errMaxStreamsLimitExceeded{streams: len(b.streams), limit: b.maxStreams, labels: labels}
+	}
+	b.streams[labels] = &push.Stream{
+		Labels:  labels,
+		Entries: []push.Entry{e.Entry},
+	}
+	b.bytes += entrySize(e)
+	return nil
+}
+
+// sizeBytesAfter returns the size of the batch after adding e.
+func (b *batch) sizeBytesAfter(e entry) int {
+	return b.bytes + entrySize(e)
+}
+
+// age returns the time since the batch was created.
+func (b *batch) age() time.Duration {
+	return time.Since(b.createdAt)
+}
+
+// pushRequest returns the push request of the batch.
+func (b *batch) pushRequest() *push.PushRequest {
+	req := push.PushRequest{
+		Streams: make([]push.Stream, 0, len(b.streams)),
+	}
+	for _, stream := range b.streams {
+		req.Streams = append(req.Streams, *stream)
+	}
+	return &req
+}
+
+// countEntries returns the number of entries in req.
+func countEntries(req *push.PushRequest) int {
+	entries := 0
+	for _, stream := range req.Streams {
+		entries += len(stream.Entries)
+	}
+	return entries
+}
+
+// splitPushRequest splits req into two requests with half of the entries each, keeping the order of the entries.
+func splitPushRequest(req *push.PushRequest) (*push.PushRequest, *push.PushRequest) {
+	first, second := &push.PushRequest{}, &push.PushRequest{}
+	remaining := countEntries(req) / 2
+	for _, stream := range req.Streams {
+		switch {
+		case remaining >= len(stream.Entries):
+			first.Streams = append(first.Streams, stream)
+		case remaining == 0:
+			second.Streams = append(second.Streams, stream)
+		default:
+			first.Streams = append(first.Streams, push.Stream{Labels: stream.Labels, Entries: stream.Entries[:remaining]})
+			second.Streams = append(second.Streams, push.Stream{Labels: stream.Labels, Entries: stream.Entries[remaining:]})
+		}
+		remaining -= min(remaining, len(stream.Entries))
+	}
+	return first, second
+}
+
+// entrySize is the size of e counted against batchsize.
+func entrySize(e entry) int {
+	size := len(e.Line)
+	for _, l := range e.StructuredMetadata {
+		size += l.Size()
+	}
+	return size
+}
+
+// labelsString formats ls as stream selector like {host="web-1", job="caddy"}, without the tenant label.
+func labelsString(ls model.LabelSet) string {
+	names := make([]string, 0, len(ls))
+	for name := range ls {
+		if name == reservedLabelTenantID {
+			continue
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(string(ls[model.LabelName(name)])))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
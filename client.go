@@ -0,0 +1,558 @@
+package caddy_logger_loki
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/grafana/loki/pkg/push"
+	"github.com/prometheus/common/config"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The client is a lightweight replacement of the promtail client, which pulled most of Loki into every Caddy
+build. It batches entries per tenant and pushes them with the same semantics: batchwait and batchsize, backoff on
+429, 5xx and connection errors, max_streams and the line size limits.
+*/
+
+const (
+	userAgent = "caddy-logger-loki"
+
+	// maximum length of an error message read from a response
+	maxErrMsgLen = 1024
+	// maximum length of an error response read, to find the entries rejected by the server
+	maxErrBodyLen = 64 * 1024
+)
+
+// clientConfig configures a client, it mirrors the promtail client.Config.
+type clientConfig struct {
+	URL       *url.URL
+	BatchWait time.Duration
+	BatchSize int
+
+	// only used to build the transport, see newRoundTripper
+	Client config.HTTPClientConfig
+
+	Headers       map[string]string
+	BackoffConfig backoffConfig
+	Timeout       time.Duration
+
+	// The tenant ID to use when pushing logs to Loki (empty string means single tenant mode)
+	TenantID string
+
+	DropRateLimitedBatches bool
+
+	// re-stamp entries rejected for being too old with the current time and send them again
+	RestampTooFarBehind bool
+
+	MaxStreams          int
+	MaxLineSize         int
+	MaxLineSizeTruncate bool
+	// shorten the string fields of JSON lines instead of cutting them at max_line_size
+	MaxLineSizeTruncateJSON bool
+
+	// number of workers batching and sending the streams sharded to them, and the limit of concurrent push requests
+	Workers            int
+	MaxInflightBatches int
+
+	// encoder of the request body
+	Encoder encoder
+
+	// switches to the fallback writer while the server is unreachable, nil without fallback
+	Breaker *breaker
+
+	// keeps the dropped entries, nil without dead_letter
+	DeadLetter *deadLetter
+}
+
+/*
+client pushes entries in batches. Streams are sharded across workers, each batching and sending the entries of
+its streams one batch after another, so the entries of a stream are pushed in order.
+*/
+type client struct {
+	cfg     clientConfig
+	client  *http.Client
+	metrics *metrics
+	logger  logger
+
+	// queue of every worker
+	queues []*queue
+	// semaphore of the batches being sent
+	inflight chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+
+	// ctx is canceled to stop retrying
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newClient(cfg clientConfig, rt http.RoundTripper, metrics *metrics, logger logger) *client {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxInflightBatches < 1 {
+		cfg.MaxInflightBatches = cfg.Workers
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &client{
+		cfg:      cfg,
+		client:   &http.Client{Transport: rt},
+		metrics:  metrics,
+		logger:   logger,
+		queues:   make([]*queue, cfg.Workers),
+		inflight: make(chan struct{}, cfg.MaxInflightBatches),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	c.wg.Add(cfg.Workers)
+	for i := range c.queues {
+		c.queues[i] = newQueue()
+		go c.run(c.queues[i])
+	}
+	return c
+}
+
+/*
+handle hands e to the worker of its stream. Entries handed after Stop, or while the queue is full after StopNow, are
+dropped.
+*/
+func (c *client) handle(e entry) {
+	if e.stream == "" {
+		e.stream = labelsString(e.labels)
+	}
+	if !enqueue(c.queue(e.stream), e, e.Line) {
+		c.dropped(e, len(e.Line))
+	}
+}
+
+// handleLine is handle for an entry with line, which is copied, so it doesn't need to be converted to a string.
+func (c *client) handleLine(e entry, line []byte) {
+	if !enqueue(c.queue(e.stream), e, line) {
+		e.Line = string(line)
+		c.dropped(e, len(line))
+	}
+}
+
+// dropped counts e, with a line of size bytes, as dropped as the client is stopping, and writes it to the dead letter.
+func (c *client) dropped(e entry, size int) {
+	tenantID := c.tenantID(e)
+	c.metrics.droppedEntries.WithLabelValues(c.cfg.URL.Host, tenantID, reasonGeneric).Inc()
+	c.metrics.droppedBytes.WithLabelValues(c.cfg.URL.Host, tenantID, reasonGeneric).Add(float64(size))
+	c.writeDeadLetter(tenantID, reasonGeneric, e.pushStream())
+}
+
+// queue returns the queue of the worker of stream, streams are sharded by their fnv32a hash.
+func (c *client) queue(stream string) *queue {
+	if len(c.queues) == 1 {
+		return c.queues[0]
+	}
+	const offset32, prime32 = 2166136261, 16777619
+	h := uint32(offset32)
+	for i := 0; i < len(stream); i++ {
+		h ^= uint32(stream[i])
+		h *= prime32
+	}
+	return c.queues[h%uint32(len(c.queues))]
+}
+
+// run is the loop of a worker, batching the entries it takes from q.
+func (c *client) run(q *queue) {
+	batches := map[string]*batch{}
+
+	/*
+		There is a batch per tenant, each created at a different time, so batches which reached batchwait are looked
+		for 10 times per batchwait, which delays batches by 10% of batchwait at most. The check runs at most every
+		10ms, for a very low batchwait.
+	*/
+	checkFrequency := c.cfg.BatchWait / 10
+	if checkFrequency < 10*time.Millisecond {
+		checkFrequency = 10 * time.Millisecond
+	}
+	maxWaitCheck := time.NewTicker(checkFrequency)
+
+	defer func() {
+		maxWaitCheck.Stop()
+		// send all pending batches
+		for tenantID, batch := range batches {
+			c.sendBatch(tenantID, batch)
+		}
+		c.wg.Done()
+	}()
+
+	// the buffers of the entries taken from q, swapped with the buffers of q
+	var entries []queuedEntry
+	var buf []byte
+	for {
+		select {
+		case <-q.notify:
+			closed := false
+			for {
+				entries, buf, closed = q.take(entries, buf)
+				if len(entries) == 0 {
+					break
+				}
+				lines := string(buf)
+				start := 0
+				for _, qe := range entries {
+					e := qe.entry
+					e.Line = lines[start:qe.end]
+					start = qe.end
+					c.add(batches, e)
+				}
+			}
+			if closed {
+				return
+			}
+		case <-maxWaitCheck.C:
+			// send all batches which reached batchwait
+			for tenantID, batch := range batches {
+				if batch.age() < c.cfg.BatchWait {
+					continue
+				}
+				c.sendBatch(tenantID, batch)
+				delete(batches, tenantID)
+			}
+		}
+	}
+}
+
+// add adds e to the batch of its tenant, and sends the batch first if e doesn't fit into it anymore.
+func (c *client) add(batches map[string]*batch, e entry) {
+	host := c.cfg.URL.Host
+	tenantID := c.tenantID(e)
+
+	// drop or truncate lines longer than max_line_size, 0 means disabled
+	if c.cfg.MaxLineSize != 0 && len(e.Line) > c.cfg.MaxLineSize {
+		truncated, ok := "", false
+		if c.cfg.MaxLineSizeTruncate {
+			// JSON lines which can't be truncated to valid JSON are dropped
+			truncated, ok = truncateLine(e.Line, c.cfg.MaxLineSize, c.cfg.MaxLineSizeTruncateJSON)
+		}
+		if !ok {
+			c.metrics.droppedEntries.WithLabelValues(host, tenantID, reasonLineTooLong).Inc()
+			c.metrics.droppedBytes.WithLabelValues(host, tenantID, reasonLineTooLong).Add(float64(len(e.Line)))
+			c.writeDeadLetter(tenantID, reasonLineTooLong, e.pushStream())
+			return
+		}
+		c.metrics.mutatedEntries.WithLabelValues(host, tenantID, reasonLineTooLong).Inc()
+		c.metrics.mutatedBytes.WithLabelValues(host, tenantID, reasonLineTooLong).Add(float64(len(e.Line) - len(truncated)))
+		e.Line = truncated
+	}
+
+	batch, ok := batches[tenantID]
+	if !ok {
+		batches[tenantID] = newBatch(c.cfg.MaxStreams, e)
+		return
+	}
+
+	// send the batch first if the entry doesn't fit into it anymore
+	if batch.sizeBytesAfter(e) > c.cfg.BatchSize {
+		c.sendBatch(tenantID, batch)
+		batches[tenantID] = newBatch(c.cfg.MaxStreams, e)
+		return
+	}
+
+	if err := batch.add(e); err != nil {
+		c.logger.logger.Error("batch add err", zap.String("tenant", tenantID), zap.Error(err))
+		reason := reasonGeneric
+		if errors.As(err, &errMaxStreamsLimitExceeded{}) {
+			reason = reasonStreamLimited
+		}
+		c.metrics.droppedEntries.WithLabelValues(host, tenantID, reason).Inc()
+		c.metrics.droppedBytes.WithLabelValues(host, tenantID, reason).Add(float64(len(e.Line)))
+		c.writeDeadLetter(tenantID, reason, e.pushStream())
+	}
+}
+
+// tenantID returns the tenant of e, set by the __tenant_id__ label or tenant_id.
+func (c *client) tenantID(e entry) string {
+	if value, ok := e.labels[reservedLabelTenantID]; ok {
+		return string(value)
+	}
+	return c.cfg.TenantID
+}
+
+// sendBatch pushes batch.
+func (c *client) sendBatch(tenantID string, batch *batch) {
+	c.sendRequest(tenantID, batch.pushRequest(), c.cfg.RestampTooFarBehind)
+}
+
+/*
+sendRequest pushes req, retrying with backoff until it succeeds, fails permanently or the client is stopped.
+Requests too large for the server are split in half, and only the entries it rejects are dropped, or re-stamped if
+restamp is set.
+*/
+func (c *client) sendRequest(tenantID string, req *push.PushRequest, restamp bool) {
+	entries := countEntries(req)
+	buf, err := c.cfg.Encoder.encode(req)
+	if err != nil {
+		c.logger.logger.Error("error encoding batch", zap.Error(err))
+		c.writeDeadLetter(tenantID, reasonGeneric, req.Streams...)
+		return
+	}
+	host := c.cfg.URL.Host
+	bufBytes := float64(len(buf))
+	c.metrics.encodedBytes.WithLabelValues(host).Add(bufBytes)
+
+	resp, err := c.sendWithRetries(tenantID, buf)
+	if err == nil {
+		c.metrics.sentBytes.WithLabelValues(host).Add(bufBytes)
+		c.metrics.sentEntries.WithLabelValues(host).Add(float64(entries))
+		return
+	}
+
+	// count the drops as rate limited if the last attempt was, even if the attempts before failed for other reasons
+	reason := reasonGeneric
+	switch resp.status {
+	case http.StatusTooManyRequests:
+		if c.cfg.DropRateLimitedBatches {
+			c.logger.logger.Warn("dropping batch due to rate limiting applied at ingester")
+		}
+		reason = reasonRateLimited
+	case http.StatusRequestEntityTooLarge:
+		if entries > 1 {
+			c.logger.logger.Warn("batch is too large for the server, sending it in two halves", zap.String("tenant", tenantID), zap.Int("entries", entries))
+			first, second := splitPushRequest(req)
+			c.sendRequest(tenantID, first, restamp)
+			c.sendRequest(tenantID, second, restamp)
+			return
+		}
+		reason = reasonRequestTooLarge
+	case http.StatusBadRequest:
+		// the server accepted all the entries except the rejected ones
+		if rejections := parseRejections(resp.body); len(rejections) > 0 {
+			c.metrics.sentBytes.WithLabelValues(host).Add(bufBytes)
+			c.handleRejections(tenantID, req, rejections, restamp)
+			return
+		}
+	}
+
+	// the server is unreachable, keep the batch in the fallback writer instead of dropping it
+	if c.cfg.Breaker != nil {
+		if ok, fallbackErr := c.cfg.Breaker.writeRequest(req); ok {
+			c.logger.logger.Warn("writing batch to the fallback writer", zap.String("tenant", tenantID), zap.Error(err))
+			if fallbackErr == nil {
+				c.metrics.fallbackEntries.WithLabelValues(host).Add(float64(entries))
+				return
+			}
+			c.logger.logger.Error("error writing batch to the fallback writer", zap.Error(fallbackErr))
+		}
+	}
+
+	c.logger.logger.Error("final error sending batch", zap.Int("status", resp.status), zap.String("tenant", tenantID), zap.Error(err))
+	c.metrics.droppedBytes.WithLabelValues(host, tenantID, reason).Add(bufBytes)
+	c.metrics.droppedEntries.WithLabelValues(host, tenantID, reason).Add(float64(entries))
+	c.writeDeadLetter(tenantID, reason, req.Streams...)
+}
+
+// writeDeadLetter writes the entries of streams dropped for reason to the dead letter file, if configured.
+func (c *client) writeDeadLetter(tenantID, reason string, streams ...push.Stream) {
+	if c.cfg.DeadLetter == nil {
+		return
+	}
+	for _, stream := range streams {
+		labels, err := parseLabels(stream.Labels)
+		if err != nil {
+			c.logger.logger.Error("error parsing labels of dropped entries", zap.Error(err))
+			continue
+		}
+		if err := c.cfg.DeadLetter.write(tenantID, reason, labels, stream.Entries...); err != nil {
+			c.logger.logger.Error("error writing to the dead letter file", zap.Error(err))
+		}
+	}
+}
+
+// sendWithRetries sends buf until it succeeds, fails permanently or the retries are exhausted.
+func (c *client) sendWithRetries(tenantID string, buf []byte) (pushResponse, error) {
+	c.inflight <- struct{}{}
+	defer func() { <-c.inflight }()
+
+	host := c.cfg.URL.Host
+	backoff := newBackoff(c.ctx, c.cfg.BackoffConfig)
+	for {
+		start := time.Now()
+		// send uses the timeout internally, so it isn't canceled by c.ctx and the last attempt completes on stop
+		resp, err := c.send(context.Background(), tenantID, buf)
+		c.metrics.requestDuration.WithLabelValues(strconv.Itoa(resp.status), host).Observe(time.Since(start).Seconds())
+		c.recordReachability(resp)
+		if err == nil {
+			return resp, nil
+		}
+
+		// drop rate limited batches right away, so they don't delay the batches of other tenants
+		if c.cfg.DropRateLimitedBatches && resp.status == http.StatusTooManyRequests {
+			return resp, err
+		}
+		// only retry 429s, 5xx and connection errors
+		if resp.status > 0 && resp.status != http.StatusTooManyRequests && resp.status/100 != 5 {
+			return resp, err
+		}
+
+		c.logger.logger.Warn("error sending batch, will retry", zap.Int("status", resp.status), zap.String("tenant", tenantID), zap.Error(err))
+		c.metrics.batchRetries.WithLabelValues(host, tenantID).Inc()
+		backoff.wait(resp.retryAfter)
+
+		// the batch is sent at least once, before checking for retries
+		if !backoff.ongoing() {
+			return resp, err
+		}
+	}
+}
+
+// reachable reports whether the server responded, connection errors and 5xx count as unreachable.
+func (r pushResponse) reachable() bool {
+	return r.status > 0 && r.status/100 != 5
+}
+
+// recordReachability passes the outcome of a request to the breaker, and starts probing the server if it opened.
+func (c *client) recordReachability(resp pushResponse) {
+	if c.cfg.Breaker == nil {
+		return
+	}
+	if resp.reachable() {
+		if c.cfg.Breaker.success() {
+			c.metrics.fallbackActive.WithLabelValues(c.cfg.URL.Host).Set(0)
+		}
+		return
+	}
+	if c.cfg.Breaker.failure() {
+		c.metrics.fallbackActive.WithLabelValues(c.cfg.URL.Host).Set(1)
+		go c.probe()
+	}
+}
+
+/*
+probe sends empty push requests while the breaker is open, as no entries are sent to the server, until it
+responds again or the client is stopped.
+*/
+func (c *client) probe() {
+	buf, err := c.cfg.Encoder.encode(&push.PushRequest{})
+	if err != nil {
+		c.logger.logger.Error("error encoding probe request", zap.Error(err))
+		return
+	}
+	ticker := time.NewTicker(c.cfg.Breaker.probeInterval)
+	defer ticker.Stop()
+	for c.cfg.Breaker.isOpen() {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			resp, _ := c.send(c.ctx, c.cfg.TenantID, buf)
+			c.recordReachability(resp)
+		}
+	}
+}
+
+// pushResponse is the outcome of a push request.
+type pushResponse struct {
+	// -1 if no response was received
+	status int
+	// delay requested by the Retry-After header of a 429 or 503 response
+	retryAfter time.Duration
+	// body of an error response, up to maxErrBodyLen
+	body string
+}
+
+// send does a single push request.
+func (c *client) send(ctx context.Context, tenantID string, buf []byte) (pushResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL.String(), bytes.NewReader(buf))
+	if err != nil {
+		return pushResponse{status: -1}, err
+	}
+	req.Header.Set("Content-Type", c.cfg.Encoder.contentType)
+	if c.cfg.Encoder.contentEncoding != "" {
+		req.Header.Set("Content-Encoding", c.cfg.Encoder.contentEncoding)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", tenantID)
+	}
+	for k, v := range c.cfg.Headers {
+		if req.Header.Get(k) != "" {
+			c.logger.logger.Warn("custom header key already exists, skipping", zap.String("key", k))
+			continue
+		}
+		req.Header.Add(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return pushResponse{status: -1}, err
+	}
+	defer resp.Body.Close()
+
+	result := pushResponse{status: resp.StatusCode}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrBodyLen))
+		result.body = string(body)
+		line, _, _ := strings.Cut(result.body, "\n")
+		if len(line) > maxErrMsgLen {
+			line = line[:maxErrMsgLen]
+		}
+		err = fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			result.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+	}
+	return result, err
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as HTTP date, 0 means none or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Stop sends the pending batches, with retries, and stops the client.
+func (c *client) Stop() {
+	c.once.Do(func() {
+		for _, q := range c.queues {
+			q.close()
+		}
+	})
+	c.wg.Wait()
+	// stop probing
+	c.cancel()
+}
+
+// StopNow sends the pending batches once, without retries, and stops the client.
+func (c *client) StopNow() {
+	c.abort()
+	c.Stop()
+}
+
+/*
+abort stops retrying, so the workers send their pending batches once, and stops writes from waiting for full
+queues. The client keeps taking entries until it is stopped.
+*/
+func (c *client) abort() {
+	c.cancel()
+	for _, q := range c.queues {
+		q.abort()
+	}
+}
@@ -0,0 +1,538 @@
+package caddy_logger_loki
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/snappy"
+	logproto "github.com/grafana/loki/pkg/push"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receivedPush is a push request received by the test server.
+type receivedPush struct {
+	header http.Header
+	path   string
+	body   []byte
+	time   time.Time
+	// the decoded request, nil if it isn't protobuf
+	req *logproto.PushRequest
+	// status the server responded with
+	status int
+}
+
+/*
+testServer is a push server recording the requests it receives. It responds with the given statuses in turn, then
+with the status and body returned by respond, or 204.
+*/
+type testServer struct {
+	statuses []int
+	respond  func(push receivedPush) (int, string)
+	// Retry-After header of 429 and 503 responses
+	retryAfter string
+	// doesn't record the requests, for benchmarks
+	discard bool
+
+	mu     sync.Mutex
+	url    string
+	pushes []receivedPush
+}
+
+// start starts s, if it isn't yet, and returns its URL. s is closed when t completes.
+func (s *testServer) start(t testing.TB) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.url == "" {
+		server := httptest.NewServer(s)
+		t.Cleanup(server.Close)
+		s.url = server.URL
+	}
+	return s.url
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.discard {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	push := receivedPush{header: r.Header.Clone(), path: r.URL.Path, body: body, time: time.Now()}
+	if r.Header.Get("Content-Type") == encoders[encodingProtobuf].contentType {
+		if buf, err := snappy.Decode(nil, body); err == nil {
+			push.req = &logproto.PushRequest{}
+			_ = push.req.Unmarshal(buf)
+		}
+	}
+
+	s.mu.Lock()
+	i := len(s.pushes)
+	s.pushes = append(s.pushes, push)
+	status, msg := http.StatusNoContent, ""
+	respond := s.respond
+	if len(s.statuses) > 0 {
+		status, s.statuses, respond = s.statuses[0], s.statuses[1:], nil
+	}
+	s.mu.Unlock()
+
+	// respond may block, so concurrent requests aren't serialized by the mutex
+	if respond != nil {
+		status, msg = respond(push)
+	}
+	s.mu.Lock()
+	s.pushes[i].status = status
+	s.mu.Unlock()
+
+	if s.retryAfter != "" && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) {
+		w.Header().Set("Retry-After", s.retryAfter)
+	}
+	if msg != "" {
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// received returns the push requests received so far.
+func (s *testServer) received() []receivedPush {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedPush(nil), s.pushes...)
+}
+
+// first returns the first push request received, it fails t if there is none.
+func (s *testServer) first(t *testing.T) receivedPush {
+	t.Helper()
+	pushes := s.received()
+	if len(pushes) == 0 {
+		t.Fatalf("no push request received")
+	}
+	return pushes[0]
+}
+
+// requests returns the decoded push requests received so far.
+func (s *testServer) requests() []*logproto.PushRequest {
+	var requests []*logproto.PushRequest
+	for _, push := range s.received() {
+		requests = append(requests, push.req)
+	}
+	return requests
+}
+
+// tenants returns the tenant of every push request received so far.
+func (s *testServer) tenants() []string {
+	var tenants []string
+	for _, push := range s.received() {
+		tenants = append(tenants, push.header.Get("X-Scope-OrgID"))
+	}
+	return tenants
+}
+
+// entries returns the lines received per request.
+func (s *testServer) entries() [][]string {
+	var lines [][]string
+	for _, push := range s.received() {
+		lines = append(lines, requestLines(push.req))
+	}
+	return lines
+}
+
+// stored returns the lines of the requests the server accepted, in the order they were received.
+func (s *testServer) stored() []string {
+	var lines []string
+	for _, push := range s.received() {
+		if push.status/100 == 2 {
+			lines = append(lines, requestLines(push.req)...)
+		}
+	}
+	return lines
+}
+
+// requestLines returns the lines of req.
+func requestLines(req *logproto.PushRequest) []string {
+	var lines []string
+	if req == nil {
+		return lines
+	}
+	for _, stream := range req.Streams {
+		for _, e := range stream.Entries {
+			lines = append(lines, e.Line)
+		}
+	}
+	return lines
+}
+
+/*
+newTestClient starts a client pushing to s. Unset options default to a single batch per test and a backoff short
+enough for tests.
+*/
+func newTestClient(t testing.TB, s *testServer, cfg clientConfig) (*client, *metrics) {
+	cfg.URL, _ = url.Parse(s.start(t) + "/loki/api/v1/push")
+	if cfg.BatchWait == 0 {
+		cfg.BatchWait = time.Hour
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 1 << 20
+	}
+	if cfg.BackoffConfig == (backoffConfig{}) {
+		cfg.BackoffConfig = backoffConfig{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, MaxRetries: 3}
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.Encoder.encode == nil {
+		cfg.Encoder = encoders[encodingProtobuf]
+	}
+	m := newMetrics(prometheus.NewRegistry())
+	return newClient(cfg, http.DefaultTransport, m, newLogger(zap.NewNop())), m
+}
+
+func sendLines(c *client, labels model.LabelSet, lines ...string) {
+	for _, line := range lines {
+		c.handle(entry{labels: labels, Entry: logproto.Entry{Timestamp: time.Now(), Line: line}})
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Collector) float64 {
+	var m dto.Metric
+	if err := c.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestClientBatching(t *testing.T) {
+	s := &testServer{}
+	c, _ := newTestClient(t, s, clientConfig{BatchSize: 10})
+	sendLines(c, model.LabelSet{"job": "caddy"}, "12345", "67890", "abc")
+	c.Stop()
+
+	entries := s.entries()
+	if len(entries) != 2 || len(entries[0]) != 2 || len(entries[1]) != 1 {
+		t.Fatalf("expected a full batch of 2 entries and one of 1 entry, got %v", entries)
+	}
+
+	s = &testServer{}
+	c, _ = newTestClient(t, s, clientConfig{BatchWait: 50 * time.Millisecond})
+	sendLines(c, model.LabelSet{"job": "caddy"}, "hello")
+	time.Sleep(200 * time.Millisecond)
+	if entries := s.entries(); len(entries) != 1 {
+		t.Fatalf("expected the batch to be sent after batchwait, got %v", entries)
+	}
+	c.Stop()
+}
+
+func TestClientTenant(t *testing.T) {
+	s := &testServer{}
+	c, _ := newTestClient(t, s, clientConfig{TenantID: "default"})
+	sendLines(c, model.LabelSet{"job": "caddy", reservedLabelTenantID: "team-a"}, "a")
+	c.Stop()
+
+	if tenants := s.tenants(); len(tenants) != 1 || tenants[0] != "team-a" {
+		t.Fatalf("expected tenant team-a, got %v", tenants)
+	}
+	if labels := s.requests()[0].Streams[0].Labels; labels != `{job="caddy"}` {
+		t.Fatalf("expected the tenant label to be removed, got %s", labels)
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    clientConfig
+		labels []model.LabelSet
+		// the second line, default is 123456
+		long     string
+		expected []string
+		reason   string
+	}{
+		{
+			name:     "line too long",
+			cfg:      clientConfig{MaxLineSize: 4},
+			labels:   []model.LabelSet{{"job": "a"}, {"job": "a"}},
+			expected: []string{"1234"},
+			reason:   reasonLineTooLong,
+		},
+		{
+			name:     "line truncated",
+			cfg:      clientConfig{MaxLineSize: 4, MaxLineSizeTruncate: true},
+			labels:   []model.LabelSet{{"job": "a"}, {"job": "a"}},
+			expected: []string{"1234", "1234"},
+		},
+		{
+			name:     "non json line truncated in json mode",
+			cfg:      clientConfig{MaxLineSize: 4, MaxLineSizeTruncate: true, MaxLineSizeTruncateJSON: true},
+			labels:   []model.LabelSet{{"job": "a"}, {"job": "a"}},
+			expected: []string{"1234", "1234"},
+		},
+		{
+			name:     "json line not fitting dropped",
+			cfg:      clientConfig{MaxLineSize: 4, MaxLineSizeTruncate: true, MaxLineSizeTruncateJSON: true},
+			labels:   []model.LabelSet{{"job": "a"}, {"job": "a"}},
+			long:     `{"status":200}`,
+			expected: []string{"1234"},
+			reason:   reasonLineTooLong,
+		},
+		{
+			name:     "max streams",
+			cfg:      clientConfig{MaxStreams: 1},
+			labels:   []model.LabelSet{{"job": "a"}, {"job": "b"}},
+			expected: []string{"1234"},
+			reason:   reasonStreamLimited,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testServer{}
+			c, m := newTestClient(t, s, test.cfg)
+			sendLines(c, test.labels[0], "1234")
+			long := test.long
+			if long == "" {
+				long = "123456"
+			}
+			sendLines(c, test.labels[1], long)
+			c.Stop()
+
+			entries := s.entries()
+			if len(entries) != 1 || len(entries[0]) != len(test.expected) {
+				t.Fatalf("expected entries %v, got %v", test.expected, entries)
+			}
+			for i, line := range test.expected {
+				if entries[0][i] != line {
+					t.Fatalf("expected entries %v, got %v", test.expected, entries)
+				}
+			}
+			if test.reason != "" {
+				if dropped := counterValue(t, m.droppedEntries.WithLabelValues(c.cfg.URL.Host, "", test.reason)); dropped != 1 {
+					t.Fatalf("expected 1 dropped entry with reason %s, got %v", test.reason, dropped)
+				}
+			}
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name                   string
+		statuses               []int
+		dropRateLimitedBatches bool
+		requests               int
+		sent                   float64
+		reason                 string
+	}{
+		{"success", nil, false, 1, 1, ""},
+		{"server error is retried", []int{500, 503}, false, 3, 1, ""},
+		{"rate limit is retried", []int{429}, false, 2, 1, ""},
+		{"rate limited batches are dropped", []int{429}, true, 1, 0, reasonRateLimited},
+		{"client error isn't retried", []int{400}, false, 1, 0, reasonGeneric},
+		{"retries are exhausted", []int{500, 500, 429}, false, 3, 0, reasonRateLimited},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testServer{statuses: test.statuses}
+			c, m := newTestClient(t, s, clientConfig{DropRateLimitedBatches: test.dropRateLimitedBatches})
+			sendLines(c, model.LabelSet{"job": "caddy"}, "hello")
+			c.Stop()
+
+			if requests := s.requests(); len(requests) != test.requests {
+				t.Fatalf("expected %d requests, got %d", test.requests, len(requests))
+			}
+			host := c.cfg.URL.Host
+			if sent := counterValue(t, m.sentEntries.WithLabelValues(host)); sent != test.sent {
+				t.Fatalf("expected %v sent entries, got %v", test.sent, sent)
+			}
+			if test.reason != "" {
+				if dropped := counterValue(t, m.droppedEntries.WithLabelValues(host, "", test.reason)); dropped != 1 {
+					t.Fatalf("expected 1 dropped entry with reason %s, got %v", test.reason, dropped)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(context.Background(), backoffConfig{MinBackoff: time.Second, MaxBackoff: 5 * time.Second, MaxRetries: 5})
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if !b.ongoing() {
+			t.Fatalf("expected backoff to be ongoing before retry %d", i+1)
+		}
+		if d := b.delay(); d != e {
+			t.Fatalf("expected delay %v for retry %d, got %v", e, i+1, d)
+		}
+	}
+	if b.ongoing() {
+		t.Fatalf("expected backoff to stop after max retries")
+	}
+
+	b = newBackoff(context.Background(), backoffConfig{MinBackoff: 10 * time.Second, MaxBackoff: time.Minute, Jitter: 0.2})
+	for _, test := range []struct {
+		random   float64
+		expected time.Duration
+	}{{0, 8 * time.Second}, {0.5, 20 * time.Second}, {0.75, 44 * time.Second}} {
+		b.random = func() float64 { return test.random }
+		if d := b.delay(); d != test.expected {
+			t.Fatalf("expected delay %v for random %v, got %v", test.expected, test.random, d)
+		}
+	}
+
+	b = newBackoff(context.Background(), backoffConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Hour, MaxElapsed: 100 * time.Millisecond})
+	start := time.Now()
+	for b.ongoing() {
+		b.wait(0)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected retries to stop within max_elapsed, took %v", elapsed)
+	}
+	b = newBackoff(context.Background(), backoffConfig{MinBackoff: time.Minute, MaxBackoff: time.Hour, MaxElapsed: time.Minute})
+	if b.next(0); b.ongoing() {
+		t.Fatalf("expected a delay beyond max_elapsed to stop the retries")
+	}
+}
+
+func TestBackoffRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxElapsed time.Duration
+		retryAfter time.Duration
+		// the delay is at most expected, and more than expected minus a second
+		expected time.Duration
+	}{
+		{"retry after", 0, 2 * time.Second, 2 * time.Second},
+		{"limited to max_period", 0, 24 * time.Hour, 5 * time.Second},
+		{"limited to max_elapsed", 3 * time.Second, 24 * time.Hour, 3 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBackoff(context.Background(), backoffConfig{MinBackoff: time.Second, MaxBackoff: 5 * time.Second, MaxElapsed: test.maxElapsed})
+			if d := b.next(test.retryAfter); d > test.expected || d <= test.expected-time.Second {
+				t.Fatalf("expected a delay of %v, got %v", test.expected, d)
+			}
+			if !b.ongoing() {
+				t.Fatalf("expected the retry to be made")
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header   string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Thu, 01 Aug 2024 12:00:30 GMT", 30 * time.Second},
+		{"Thu, 01 Aug 2024 11:00:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			if d := parseRetryAfter(test.header, now); d != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, d)
+			}
+		})
+	}
+}
+
+func TestClientRetryAfter(t *testing.T) {
+	s := &testServer{statuses: []int{http.StatusServiceUnavailable}, retryAfter: "1"}
+	backoff := backoffConfig{MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Second, MaxRetries: 3}
+	c, _ := newTestClient(t, s, clientConfig{BackoffConfig: backoff})
+	sendLines(c, model.LabelSet{"job": "caddy"}, "hello")
+	c.Stop()
+
+	pushes := s.received()
+	if len(pushes) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(pushes))
+	}
+	if d := pushes[1].time.Sub(pushes[0].time); d < time.Second {
+		t.Fatalf("expected the retry to wait for Retry-After, waited %v", d)
+	}
+
+	// the retry after exceeds max_elapsed, so the retry is made once max_elapsed is reached
+	s = &testServer{statuses: []int{http.StatusServiceUnavailable}, retryAfter: "1"}
+	backoff.MaxElapsed = 300 * time.Millisecond
+	c, _ = newTestClient(t, s, clientConfig{BackoffConfig: backoff})
+	sendLines(c, model.LabelSet{"job": "caddy"}, "hello")
+	c.Stop()
+	pushes = s.received()
+	if len(pushes) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(pushes))
+	}
+	if d := pushes[1].time.Sub(pushes[0].time); d >= time.Second {
+		t.Fatalf("expected the retry to wait for max_elapsed, waited %v", d)
+	}
+}
+
+func TestClientWorkers(t *testing.T) {
+	var inflight, maxInflight atomic.Int32
+	s := &testServer{respond: func(receivedPush) (int, string) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			m := maxInflight.Load()
+			if n <= m || maxInflight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return http.StatusNoContent, ""
+	}}
+	c, _ := newTestClient(t, s, clientConfig{BatchSize: 4, Workers: 4, MaxInflightBatches: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(job string) {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				sendLines(c, model.LabelSet{"job": model.LabelValue(job)}, fmt.Sprintf("%04d", n))
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	c.Stop()
+
+	streams := map[string][]string{}
+	for _, req := range s.requests() {
+		for _, stream := range req.Streams {
+			for _, e := range stream.Entries {
+				streams[stream.Labels] = append(streams[stream.Labels], e.Line)
+			}
+		}
+	}
+	if len(streams) != 8 {
+		t.Fatalf("expected 8 streams, got %d", len(streams))
+	}
+	for labels, lines := range streams {
+		if len(lines) != 10 {
+			t.Fatalf("expected 10 entries for stream %s, got %v", labels, lines)
+		}
+		for n, line := range lines {
+			if line != fmt.Sprintf("%04d", n) {
+				t.Fatalf("entries of stream %s are out of order: %v", labels, lines)
+			}
+		}
+	}
+	if m := maxInflight.Load(); m != 2 {
+		t.Fatalf("expected 2 batches in flight at most, got %d", m)
+	}
+}
@@ -0,0 +1,113 @@
+package caddy_logger_loki
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+func init() {
+	caddycmd.RegisterCommand(repushCommand)
+}
+
+// repushCommand pushes a dead letter file again.
+var repushCommand = caddycmd.Command{
+	Name:  "loki-repush",
+	Usage: "--file <dead_letter_file> --url <url> [--backend <name>] [--encoding <name>] [--protocol <name>] [--tenant-id <id>] [--header <key: value>] [--bearer-token-file <file>]",
+	Short: "Pushes the entries of a dead letter file to Loki again",
+	Long: `
+Pushes the entries of a dead letter file, written by the dead_letter option of
+the loki log writer, to Loki again. The entries keep their labels, timestamps
+and tenants, entries without tenant are pushed with --tenant-id.
+
+Entries dropped again are reported, the dead letter file is left as is.`,
+	CobraFunc: func(cmd *cobra.Command) {
+		cmd.Flags().StringP("file", "f", "", "The dead letter file")
+		cmd.Flags().String("url", "", "The url of Loki")
+		cmd.Flags().String("backend", "", "The backend, see the backend option")
+		cmd.Flags().String("encoding", "", "The encoding, see the encoding option")
+		cmd.Flags().String("protocol", "", "The protocol, see the protocol option")
+		cmd.Flags().String("tenant-id", "", "The tenant of entries without tenant")
+		cmd.Flags().StringArrayP("header", "H", nil, "Header to send, as 'Key: Value'")
+		cmd.Flags().String("bearer-token-file", "", "File with the bearer token to authenticate with")
+		cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdRepush)
+	},
+}
+
+func cmdRepush(fl caddycmd.Flags) (int, error) {
+	file := fl.String("file")
+	if file == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("--file is required")
+	}
+	headers, err := fl.GetStringArray("header")
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	l := &LokiLog{
+		Url:           fl.String("url"),
+		Backend:       fl.String("backend"),
+		Encoding:      fl.String("encoding"),
+		Protocol:      fl.String("protocol"),
+		TenantId:      fl.String("tenant-id"),
+		BearTokenFile: fl.String("bearer-token-file"),
+		// the records have their own labels, these are only required by Validate for the writer
+		Labels: map[string]string{"job": "loki-repush"},
+		logger: newLogger(caddy.Log()),
+	}
+	if len(headers) > 0 {
+		l.Headers = map[string]string{}
+		for _, h := range headers {
+			key, value, ok := strings.Cut(h, ":")
+			if !ok {
+				return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid header %q, expected 'Key: Value'", h)
+			}
+			l.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if err := l.Validate(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	rt, err := l.newRoundTripper()
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	m := newMetrics(prometheus.NewRegistry())
+	c := newClient(l.clientConfig, rt, m, l.logger)
+	records, err := readDeadLetter(file, func(r deadLetterRecord) {
+		c.handle(r.entry())
+	})
+	c.Stop()
+	if err != nil {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("reading %s failed after %d entries: %v", file, records, err)
+	}
+
+	sent, dropped := counterTotal(m.sentEntries), counterTotal(m.droppedEntries)
+	fmt.Printf("pushed %d of %d entries, %d dropped\n", int(sent), records, int(dropped))
+	if dropped > 0 {
+		return caddy.ExitCodeFailedQuit, fmt.Errorf("%d entries dropped", int(dropped))
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// counterTotal returns the sum of all the counters of c.
+func counterTotal(c *prometheus.CounterVec) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	total := 0.0
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err == nil {
+			total += m.GetCounter().GetValue()
+		}
+	}
+	return total
+}
@@ -0,0 +1,147 @@
+package caddy_logger_loki
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/grafana/loki/pkg/push"
+	"github.com/prometheus/common/model"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	Entries dropped by the client, after all retries, for rate limiting or rejected by the server, are lost. The
+dead letter file keeps them as JSON lines, with their labels, timestamp and the reason they were dropped for, as
+proof of what was lost. The loki-repush command pushes a dead letter file again.
+*/
+
+const (
+	defaultDeadLetterRollSizeMB = 100
+	defaultDeadLetterRollKeep   = 10
+)
+
+// DeadLetter configures the file dropped entries are written to.
+type DeadLetter struct {
+	// The file dropped entries are written to as JSON lines.
+	Filename string `json:"filename,omitempty"`
+
+	// Size in megabytes at which the file is rotated, default is 100.
+	RollSizeMB int `json:"roll_size_mb,omitempty"`
+
+	// Number of rotated files to keep, default is 10.
+	RollKeep int `json:"roll_keep,omitempty"`
+
+	// Whether to gzip rotated files, default is false.
+	RollGzip bool `json:"roll_gzip,omitempty"`
+}
+
+// deadLetterRecord is a dropped entry in the dead letter file.
+type deadLetterRecord struct {
+	Labels             map[string]string `json:"labels"`
+	Tenant             string            `json:"tenant,omitempty"`
+	Timestamp          time.Time         `json:"timestamp"`
+	Line               string            `json:"line"`
+	StructuredMetadata map[string]string `json:"structured_metadata,omitempty"`
+	Reason             string            `json:"reason"`
+	DroppedAt          time.Time         `json:"dropped_at"`
+}
+
+// entry returns the entry of r, with the tenant as __tenant_id__ label.
+func (r deadLetterRecord) entry() entry {
+	e := entry{
+		labels: model.LabelSet{},
+		Entry:  push.Entry{Timestamp: r.Timestamp, Line: r.Line},
+	}
+	for k, v := range r.Labels {
+		e.labels[model.LabelName(k)] = model.LabelValue(v)
+	}
+	if r.Tenant != "" {
+		e.labels[reservedLabelTenantID] = model.LabelValue(r.Tenant)
+	}
+	for k, v := range r.StructuredMetadata {
+		e.StructuredMetadata = append(e.StructuredMetadata, push.LabelAdapter{Name: k, Value: v})
+	}
+	return e
+}
+
+// deadLetter writes dropped entries to a rotating file.
+type deadLetter struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func newDeadLetter(cfg *DeadLetter) *deadLetter {
+	w := &lumberjack.Logger{
+		Filename:   cfg.Filename,
+		MaxSize:    cfg.RollSizeMB,
+		MaxBackups: cfg.RollKeep,
+		Compress:   cfg.RollGzip,
+		LocalTime:  true,
+	}
+	return &deadLetter{w: w, enc: json.NewEncoder(w)}
+}
+
+// write writes the entries of a stream dropped for reason.
+func (d *deadLetter) write(tenantID, reason string, labels map[string]string, entries ...push.Entry) error {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range entries {
+		r := deadLetterRecord{
+			Labels:    labels,
+			Tenant:    tenantID,
+			Timestamp: e.Timestamp,
+			Line:      e.Line,
+			Reason:    reason,
+			DroppedAt: now,
+		}
+		if len(e.StructuredMetadata) > 0 {
+			r.StructuredMetadata = make(map[string]string, len(e.StructuredMetadata))
+			for _, l := range e.StructuredMetadata {
+				r.StructuredMetadata[l.Name] = l.Value
+			}
+		}
+		if err := d.enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.w.Close()
+}
+
+// readDeadLetter calls handle with every record of a dead letter file.
+func readDeadLetter(file string, handle func(r deadLetterRecord)) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	records := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, math.MaxInt32)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return records, fmt.Errorf("invalid record in line %d: %v", line, err)
+		}
+		handle(r)
+		records++
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,134 @@
+package caddy_logger_loki
+
+import (
+	"bytes"
+	"encoding/json"
+	logproto "github.com/grafana/loki/pkg/push"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClientDeadLetter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	d := newDeadLetter(&DeadLetter{Filename: file, RollSizeMB: 1, RollKeep: 1})
+	s := &testServer{statuses: []int{http.StatusTooManyRequests, http.StatusTooManyRequests}}
+	c, _ := newTestClient(t, s, clientConfig{
+		TenantID:               "tenant-1",
+		DropRateLimitedBatches: true,
+		MaxLineSize:            12,
+		DeadLetter:             d,
+	})
+	ts := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	c.handle(entry{labels: model.LabelSet{"job": "caddy"}, Entry: logproto.Entry{Timestamp: ts, Line: "rate limited"}})
+	c.handle(entry{labels: model.LabelSet{"job": "caddy", reservedLabelTenantID: "tenant-2"}, Entry: logproto.Entry{Timestamp: ts, Line: "line too long"}})
+	c.Stop()
+	if err := d.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var records []deadLetterRecord
+	n, err := readDeadLetter(file, func(r deadLetterRecord) { records = append(records, r) })
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 records, got %d, %v", n, err)
+	}
+	expected := []deadLetterRecord{
+		{Labels: map[string]string{"job": "caddy"}, Tenant: "tenant-2", Timestamp: ts, Line: "line too long", Reason: reasonLineTooLong},
+		{Labels: map[string]string{"job": "caddy"}, Tenant: "tenant-1", Timestamp: ts, Line: "rate limited", Reason: reasonRateLimited},
+	}
+	for i, r := range records {
+		e := expected[i]
+		if len(r.Labels) != 1 || r.Labels["job"] != "caddy" || r.Tenant != e.Tenant || !r.Timestamp.Equal(e.Timestamp) || r.Line != e.Line || r.Reason != e.Reason || r.DroppedAt.IsZero() {
+			t.Fatalf("expected record %+v, got %+v", e, r)
+		}
+	}
+
+	// the tenant is restored as label
+	e := records[0].entry()
+	if e.labels[reservedLabelTenantID] != "tenant-2" || e.labels["job"] != "caddy" || e.Line != "line too long" {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+}
+
+// TestClientDeadLetterStopped writes entries handed to a stopped client, like writes during Close, to the dead letter.
+func TestClientDeadLetterStopped(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	d := newDeadLetter(&DeadLetter{Filename: file, RollSizeMB: 1, RollKeep: 1})
+	c, m := newTestClient(t, &testServer{}, clientConfig{DeadLetter: d})
+	c.Stop()
+	ts := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	labels := model.LabelSet{"job": "caddy"}
+	c.handle(entry{labels: labels, Entry: logproto.Entry{Timestamp: ts, Line: "handled"}})
+	c.handleLine(entry{labels: labels, stream: labelsString(labels), Entry: logproto.Entry{Timestamp: ts}}, []byte("handled line"))
+	if err := d.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var lines []string
+	n, err := readDeadLetter(file, func(r deadLetterRecord) {
+		if r.Reason != reasonGeneric || r.Labels["job"] != "caddy" || !r.Timestamp.Equal(ts) {
+			t.Fatalf("unexpected record: %+v", r)
+		}
+		lines = append(lines, r.Line)
+	})
+	if err != nil || n != 2 || !slices.Equal(lines, []string{"handled", "handled line"}) {
+		t.Fatalf("expected the 2 dropped lines, got %q, %v", lines, err)
+	}
+	if dropped := counterValue(t, m.droppedEntries.WithLabelValues(c.cfg.URL.Host, "", reasonGeneric)); dropped != 2 {
+		t.Fatalf("expected 2 dropped entries, got %v", dropped)
+	}
+}
+
+func TestReadDeadLetter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	record, _ := json.Marshal(deadLetterRecord{Labels: map[string]string{"job": "caddy"}, Line: "line"})
+	content := string(record) + "\n\n" + "{invalid\n"
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n, err := readDeadLetter(file, func(deadLetterRecord) {})
+	if n != 1 || err == nil || err.Error()[:22] != "invalid record in line" {
+		t.Fatalf("expected an invalid record in line 3 after 1 record, got %d, %v", n, err)
+	}
+}
+
+func TestRepushCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	var buf bytes.Buffer
+	for _, r := range []deadLetterRecord{
+		{Labels: map[string]string{"job": "caddy"}, Tenant: "tenant-1", Timestamp: time.Now(), Line: "1"},
+		{Labels: map[string]string{"job": "caddy"}, Timestamp: time.Now(), Line: "2"},
+	} {
+		_ = json.NewEncoder(&buf).Encode(r)
+	}
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s := &testServer{}
+
+	cmd := &cobra.Command{}
+	repushCommand.CobraFunc(cmd)
+	for name, value := range map[string]string{"file": file, "url": s.start(t), "tenant-id": "default", "header": "X-Test: yes"} {
+		if err := cmd.Flags().Set(name, value); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := cmd.RunE(cmd, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tenants := s.tenants()
+	if len(tenants) != 2 {
+		t.Fatalf("expected a request per tenant, got %d", len(tenants))
+	}
+	if !slices.Contains(tenants, "tenant-1") || !slices.Contains(tenants, "default") {
+		t.Fatalf("expected tenants tenant-1 and default, got %v", tenants)
+	}
+}
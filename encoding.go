@@ -0,0 +1,125 @@
+package caddy_logger_loki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/pkg/push"
+	"strconv"
+	"strings"
+)
+
+// Encodings of the push request body.
+const (
+	// snappy-compressed protobuf, as sent by promtail
+	encodingProtobuf = "protobuf"
+	// Loki's JSON push format
+	encodingJSON = "json"
+	// Loki's JSON push format, gzip compressed
+	encodingJSONGzip = "json+gzip"
+)
+
+// encoder turns a push request into a request body.
+type encoder struct {
+	contentType     string
+	contentEncoding string
+	encode          func(req *push.PushRequest) ([]byte, error)
+}
+
+var encoders = map[string]encoder{
+	encodingProtobuf: {
+		contentType: "application/x-protobuf",
+		encode: func(req *push.PushRequest) ([]byte, error) {
+			b, err := req.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			return snappy.Encode(nil, b), nil
+		},
+	},
+	encodingJSON: {
+		contentType: "application/json",
+		encode:      encodeJSON,
+	},
+	encodingJSONGzip: {
+		contentType:     "application/json",
+		contentEncoding: "gzip",
+		encode: func(req *push.PushRequest) ([]byte, error) {
+			b, err := encodeJSON(req)
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(b); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+	},
+}
+
+type jsonPushRequest struct {
+	Streams []jsonStream `json:"streams"`
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	// each value is [<unix epoch in nanoseconds>, <line>] or [<unix epoch in nanoseconds>, <line>, <structured metadata>]
+	Values [][]any `json:"values"`
+}
+
+// encodeJSON encodes req in Loki's JSON push format.
+func encodeJSON(req *push.PushRequest) ([]byte, error) {
+	r := jsonPushRequest{Streams: make([]jsonStream, 0, len(req.Streams))}
+	for _, stream := range req.Streams {
+		labels, err := parseLabels(stream.Labels)
+		if err != nil {
+			return nil, err
+		}
+		s := jsonStream{Stream: labels, Values: make([][]any, 0, len(stream.Entries))}
+		for _, entry := range stream.Entries {
+			value := []any{strconv.FormatInt(entry.Timestamp.UnixNano(), 10), entry.Line}
+			if len(entry.StructuredMetadata) > 0 {
+				metadata := make(map[string]string, len(entry.StructuredMetadata))
+				for _, l := range entry.StructuredMetadata {
+					metadata[l.Name] = l.Value
+				}
+				value = append(value, metadata)
+			}
+			s.Values = append(s.Values, value)
+		}
+		r.Streams = append(r.Streams, s)
+	}
+	return json.Marshal(r)
+}
+
+// parseLabels parses a stream selector like {host="web-1", job="caddy"} as built by labelsString.
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("invalid labels %q", s)
+	}
+	rest := strings.TrimSpace(s[1 : len(s)-1])
+	for rest != "" {
+		name, value, found := strings.Cut(rest, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid labels %q", s)
+		}
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels %q: %v", s, err)
+		}
+		unquoted, _ := strconv.Unquote(quoted)
+		labels[strings.TrimSpace(name)] = unquoted
+
+		rest = strings.TrimSpace(value[len(quoted):])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+	return labels, nil
+}
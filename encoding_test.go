@@ -0,0 +1,142 @@
+package caddy_logger_loki
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/golang/snappy"
+	logproto "github.com/grafana/loki/pkg/push"
+	"go.uber.org/zap"
+	"io"
+	"testing"
+)
+
+// pushLines validates l, writes lines through its writer and closes it, which sends the pending batch.
+func pushLines(t *testing.T, l *LokiLog, lines ...string) {
+	l.logger = newLogger(zap.NewNop())
+	if err := l.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w, err := l.OpenWriter()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	_ = w.Close()
+}
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		encoding        string
+		contentType     string
+		contentEncoding string
+	}{
+		{"", "application/x-protobuf", ""},
+		{"protobuf", "application/x-protobuf", ""},
+		{"json", "application/json", ""},
+		{"json+gzip", "application/json", "gzip"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.encoding, func(t *testing.T) {
+			s := &testServer{}
+			l := LokiLog{
+				Url:      s.start(t) + "/loki/api/v1/push",
+				Encoding: test.encoding,
+				Labels:   map[string]string{"job": "caddy", "host": `web "1"`},
+			}
+			pushLines(t, &l, `{"msg":"hello"}`)
+			push := s.first(t)
+
+			if push.header.Get("Content-Type") != test.contentType {
+				t.Fatalf("expected content type %q, got %q", test.contentType, push.header.Get("Content-Type"))
+			}
+			if push.header.Get("Content-Encoding") != test.contentEncoding {
+				t.Fatalf("expected content encoding %q, got %q", test.contentEncoding, push.header.Get("Content-Encoding"))
+			}
+
+			var labels map[string]string
+			var line string
+			switch test.contentType {
+			case "application/x-protobuf":
+				buf, err := snappy.Decode(nil, push.body)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				var req logproto.PushRequest
+				if err := req.Unmarshal(buf); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if labels, err = parseLabels(req.Streams[0].Labels); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				line = req.Streams[0].Entries[0].Line
+			case "application/json":
+				body := push.body
+				if test.contentEncoding == "gzip" {
+					zr, err := gzip.NewReader(bytes.NewReader(body))
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					if body, err = io.ReadAll(zr); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+				}
+				var req jsonPushRequest
+				if err := json.Unmarshal(body, &req); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				labels = req.Streams[0].Stream
+				line = req.Streams[0].Values[0][1].(string)
+			}
+
+			if labels["job"] != "caddy" || labels["host"] != `web "1"` {
+				t.Fatalf("unexpected labels %v", labels)
+			}
+			if line != `{"msg":"hello"}` {
+				t.Fatalf("unexpected line %q", line)
+			}
+		})
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected map[string]string
+		hasError bool
+	}{
+		{`{}`, map[string]string{}, false},
+		{`{job="caddy"}`, map[string]string{"job": "caddy"}, false},
+		{`{host="a, b=\"c\"", job="caddy"}`, map[string]string{"host": `a, b="c"`, "job": "caddy"}, false},
+		{`job="caddy"`, nil, true},
+		{`{job=caddy}`, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			labels, err := parseLabels(test.input)
+			if test.hasError {
+				if err == nil {
+					t.Fatalf("expected error for input %q, got nil", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for input %q: %v", test.input, err)
+			}
+			if len(labels) != len(test.expected) {
+				t.Fatalf("for input %q, expected %v, got %v", test.input, test.expected, labels)
+			}
+			for k, v := range test.expected {
+				if labels[k] != v {
+					t.Fatalf("for input %q, expected %v, got %v", test.input, test.expected, labels)
+				}
+			}
+		})
+	}
+}
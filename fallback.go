@@ -0,0 +1,293 @@
+package caddy_logger_loki
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/grafana/loki/pkg/push"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	While Loki is unreachable, batches are retried with backoff and finally dropped. The circuit breaker switches
+the writer to a fallback writer once Loki has been unreachable for longer than a threshold, so logs aren't lost
+during an outage. While it is open, Loki is probed with empty push requests, and the writer switches back once
+Loki responds again. With a file as fallback writer, the lines written to it during the outage can be replayed.
+*/
+
+const (
+	defaultFallbackThreshold     = time.Minute
+	defaultFallbackProbeInterval = 10 * time.Second
+)
+
+// Fallback configures the writer logs are written to while Loki is unreachable.
+type Fallback struct {
+	// The Caddy log writer module to fall back to, e.g. file or stderr.
+	WriterRaw json.RawMessage `json:"writer,omitempty" caddy:"namespace=caddy.logging.writers inline_key=output"`
+
+	// How long Loki has to be unreachable before switching to the fallback writer, default is 1m.
+	Threshold StrTimeDuration `json:"threshold,omitempty"`
+
+	// Interval of the requests probing whether Loki is reachable again, default is 10s.
+	ProbeInterval StrTimeDuration `json:"probe_interval,omitempty"`
+
+	/*
+		Push the lines written to the fallback file during the outage to Loki once it is reachable again. Lines are
+		written to it as Caddy logs them and pushed in the line format, with the timestamp of their ts field, lines
+		of failed batches are pushed as they were sent. Only supported with the file writer, the file is left as is.
+	*/
+	Replay bool `json:"replay,omitempty"`
+
+	writerOpener caddy.WriterOpener
+	// file of the file writer, empty for other writers
+	filename string
+}
+
+// provision loads the fallback writer module.
+func (f *Fallback) provision(ctx caddy.Context) error {
+	if f.WriterRaw == nil {
+		return nil
+	}
+	// the module doesn't expose its file, it is read from its config before the module is loaded
+	var file struct {
+		Output   string `json:"output"`
+		Filename string `json:"filename"`
+	}
+	if err := json.Unmarshal(f.WriterRaw, &file); err == nil && file.Output == "file" {
+		f.filename = file.Filename
+	}
+
+	mod, err := ctx.LoadModule(f, "WriterRaw")
+	if err != nil {
+		return err
+	}
+	f.writerOpener = mod.(caddy.WriterOpener)
+	return nil
+}
+
+/*
+breaker switches between Loki and the fallback writer. It opens once the server has been unreachable for longer
+than the threshold, and closes when the server responds again.
+*/
+type breaker struct {
+	threshold     time.Duration
+	probeInterval time.Duration
+	fallback      io.WriteCloser
+	// file of the fallback writer to replay, empty to not replay
+	replayFile string
+	logger     logger
+
+	mu sync.RWMutex
+	// time of the first failed request since the last successful one
+	failingSince time.Time
+	open         bool
+	// size of the replay file when the breaker opened
+	offset int64
+	// timestamps of the lines of failed batches by their offset in the replay file, they are replayed as they were sent
+	sent map[int64]time.Time
+
+	// called with the offset of the replay file when the breaker closes, set by the writer
+	onClose func(offset int64)
+}
+
+func newBreaker(f *Fallback, fallback io.WriteCloser, logger logger) *breaker {
+	b := &breaker{
+		threshold:     f.Threshold.TimeDuration(),
+		probeInterval: f.ProbeInterval.TimeDuration(),
+		fallback:      fallback,
+		logger:        logger,
+	}
+	if f.Replay {
+		b.replayFile = f.filename
+	}
+	return b
+}
+
+// isOpen reports whether logs are written to the fallback writer.
+func (b *breaker) isOpen() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.open
+}
+
+// success records a response of the server, it returns true if the breaker closed.
+func (b *breaker) success() bool {
+	b.mu.Lock()
+	b.failingSince = time.Time{}
+	if !b.open {
+		b.mu.Unlock()
+		return false
+	}
+	b.open = false
+	offset := b.offset
+	b.mu.Unlock()
+
+	b.logger.logger.Info("loki is reachable again, switching back from the fallback writer")
+	if b.onClose != nil {
+		b.onClose(offset)
+	}
+	return true
+}
+
+// failure records a failed request, it returns true if the breaker opened.
+func (b *breaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.failingSince.IsZero() {
+		b.failingSince = now
+	}
+	if b.open || now.Sub(b.failingSince) < b.threshold {
+		return false
+	}
+
+	b.open = true
+	b.offset = 0
+	b.sent = nil
+	if b.replayFile != "" {
+		if info, err := os.Stat(b.replayFile); err == nil {
+			b.offset = info.Size()
+		}
+	}
+	b.logger.logger.Warn("loki is unreachable, switching to the fallback writer", zap.Duration("unreachable_for", now.Sub(b.failingSince)))
+	return true
+}
+
+// write writes p to the fallback writer if the breaker is open, it returns false if it isn't.
+func (b *breaker) write(p []byte) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if !b.open {
+		return false, nil
+	}
+	_, err := b.fallback.Write(p)
+	return true, err
+}
+
+// writeFallback writes p to the fallback writer, whether the breaker is open or not.
+func (b *breaker) writeFallback(p []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, err := b.fallback.Write(p)
+	return err
+}
+
+/*
+writeRequest writes the lines of req to the fallback writer if the breaker is open. The lines are in the line format
+already, so with a replay file their offsets are recorded with their timestamps, to replay them as they were sent.
+*/
+func (b *breaker) writeRequest(req *push.PushRequest) (bool, error) {
+	// held for writing, so no other line is written between the recorded offsets
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return false, nil
+	}
+	offset := int64(-1)
+	if b.replayFile != "" {
+		if info, err := os.Stat(b.replayFile); err == nil {
+			offset = info.Size()
+		}
+	}
+	for _, stream := range req.Streams {
+		for _, e := range stream.Entries {
+			line := e.Line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			if _, err := io.WriteString(b.fallback, line); err != nil {
+				return true, err
+			}
+			if offset >= 0 {
+				if b.sent == nil {
+					b.sent = map[int64]time.Time{}
+				}
+				b.sent[offset] = e.Timestamp
+				offset += int64(len(line))
+			}
+		}
+	}
+	return true, nil
+}
+
+// sentAt returns the timestamp of the line of a failed batch at offset in the replay file, false for other lines.
+func (b *breaker) sentAt(offset int64) (time.Time, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ts, ok := b.sent[offset]
+	return ts, ok
+}
+
+// replayLines calls handle with every line of file after offset, and the offset of the line, until stop is closed.
+func replayLines(file string, offset int64, stop <-chan struct{}, handle func(line string, offset int64)) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, math.MaxInt32)
+	// the offset after the scanned line, including its line ending
+	next := offset
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		next += int64(advance)
+		return advance, token, err
+	})
+	for start := offset; scanner.Scan(); start = next {
+		select {
+		case <-stop:
+			return lines, nil
+		default:
+		}
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		handle(line, start)
+		lines++
+	}
+	return lines, scanner.Err()
+}
+
+// lineTimestamp returns the ts field of a JSON log line, as written by Caddy, or the current time.
+func lineTimestamp(line string) time.Time {
+	var l struct {
+		TS any `json:"ts"`
+	}
+	if json.Unmarshal([]byte(line), &l) == nil {
+		if ts, ok := fieldTimestamp(l.TS); ok {
+			return ts
+		}
+	}
+	return time.Now()
+}
+
+// fieldTimestamp parses the ts field of a JSON log line, written as seconds or RFC 3339 time by Caddy.
+func fieldTimestamp(value any) (time.Time, bool) {
+	switch ts := value.(type) {
+	case float64:
+		sec, frac := math.Modf(ts)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	case json.Number:
+		if f, err := ts.Float64(); err == nil {
+			return fieldTimestamp(f)
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,218 @@
+package caddy_logger_loki
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fallbackFile is a fallback writer appending to a file, like Caddy's file writer.
+func fallbackFile(t *testing.T) *os.File {
+	f, err := os.OpenFile(filepath.Join(t.TempDir(), "fallback.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return f
+}
+
+func TestBreaker(t *testing.T) {
+	f := fallbackFile(t)
+	defer f.Close()
+	_, _ = f.WriteString("before\n")
+
+	b := newBreaker(&Fallback{Threshold: StrTimeDuration{T: 20 * time.Millisecond}, Replay: true, filename: f.Name()}, f, newLogger(zap.NewNop()))
+	var closedAt []int64
+	b.onClose = func(offset int64) { closedAt = append(closedAt, offset) }
+
+	if b.failure() || b.isOpen() {
+		t.Fatalf("expected the breaker to stay closed below the threshold")
+	}
+	if ok, _ := b.write([]byte("loki\n")); ok {
+		t.Fatalf("expected no write to the fallback writer while closed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !b.failure() || !b.isOpen() {
+		t.Fatalf("expected the breaker to open after the threshold")
+	}
+	if b.failure() {
+		t.Fatalf("expected the breaker to open only once")
+	}
+	if ok, err := b.write([]byte("fallback\n")); !ok || err != nil {
+		t.Fatalf("expected a write to the fallback writer, got %v, %v", ok, err)
+	}
+
+	if !b.success() || b.isOpen() {
+		t.Fatalf("expected the breaker to close")
+	}
+	if b.success() {
+		t.Fatalf("expected the breaker to close only once")
+	}
+	if len(closedAt) != 1 || closedAt[0] != int64(len("before\n")) {
+		t.Fatalf("expected onClose with the offset before the outage, got %v", closedAt)
+	}
+
+	// a success resets the time the server is failing since
+	if b.failure() {
+		t.Fatalf("expected the breaker to stay closed below the threshold")
+	}
+}
+
+func TestLineTimestamp(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected time.Time
+	}{
+		{`{"level":"info","ts":1722513600.5,"msg":"handled request"}`, time.Unix(1722513600, 500000000)},
+		{`{"level":"info","ts":"2024-08-01T12:00:00.5Z","msg":"handled request"}`, time.Date(2024, 8, 1, 12, 0, 0, 500000000, time.UTC)},
+		{`handled request`, time.Time{}},
+		{`{"ts":"yesterday"}`, time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			ts := lineTimestamp(test.line)
+			if test.expected.IsZero() {
+				if time.Since(ts) > time.Minute {
+					t.Fatalf("expected the current time, got %v", ts)
+				}
+				return
+			}
+			if ts.Sub(test.expected).Abs() > time.Microsecond {
+				t.Fatalf("expected %v, got %v", test.expected, ts)
+			}
+		})
+	}
+}
+
+func TestClientFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		exclude []string
+	}{
+		{"raw", "", nil},
+		// lines written to the fallback writer during the outage are replayed without the excluded fields
+		{"exclude fields", "", []string{"request.headers"}},
+		// and with the timestamp of their ts field, though the line format has none
+		{"logfmt", "logfmt", []string{"request.headers", "ts"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var down atomic.Bool
+			down.Store(true)
+			s := &testServer{respond: func(receivedPush) (int, string) {
+				if down.Load() {
+					return http.StatusServiceUnavailable, "unavailable"
+				}
+				return http.StatusNoContent, ""
+			}}
+			f := fallbackFile(t)
+			b := newBreaker(&Fallback{ProbeInterval: StrTimeDuration{T: 5 * time.Millisecond}, Replay: true, filename: f.Name()}, f, newLogger(zap.NewNop()))
+			c, m := newTestClient(t, s, clientConfig{BatchWait: 10 * time.Millisecond, Breaker: b})
+			format, err := newLineFormatter(test.format, nil, test.exclude, "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			w := newLokiWriter(c, c.logger, map[string]string{"job": "caddy"}, nil, format)
+			line := func(n int) []byte {
+				return []byte(fmt.Sprintf(`{"ts":%d,"msg":"%d","request":{"headers":{"Cookie":["secret"]}}}`, 1722513600+n, n))
+			}
+
+			// the batch fails, opens the breaker and is written to the fallback writer
+			_, _ = w.Write(line(1))
+			waitFor(t, func() bool { return counterValue(t, m.fallbackEntries.WithLabelValues(c.cfg.URL.Host)) == 1 })
+			if _, err := w.Write(append(append(line(2), '\n'), line(3)...)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fallback := counterValue(t, m.fallbackEntries.WithLabelValues(c.cfg.URL.Host)); fallback != 3 {
+				t.Fatalf("expected 3 entries written to the fallback writer, got %v", fallback)
+			}
+
+			// the probe closes the breaker and the fallback file is replayed
+			recovered := time.Now()
+			down.Store(false)
+			waitFor(t, func() bool { return !b.isOpen() })
+			waitFor(t, func() bool { return len(s.stored()) == 3 })
+			_, _ = w.Write(line(4))
+			waitFor(t, func() bool { return len(s.stored()) == 4 })
+			if err := w.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			lines := s.stored()
+			for i, line := range lines {
+				if !strings.Contains(line, fmt.Sprintf(`"msg":"%d"`, i+1)) && !strings.Contains(line, fmt.Sprintf("msg=%d", i+1)) {
+					t.Fatalf("expected the lines in order, got %v", lines)
+				}
+				if strings.Contains(line, "Cookie") == (test.exclude != nil) || strings.HasPrefix(line, "{") == (test.format == "logfmt") {
+					t.Fatalf("expected the lines in the line format, got %v", lines)
+				}
+			}
+			// the line of the failed batch keeps the time it was written, the replayed line the time of its ts field
+			var timestamps []time.Time
+			for _, push := range s.received() {
+				if push.status/100 == 2 {
+					for _, stream := range push.req.Streams {
+						for _, e := range stream.Entries {
+							timestamps = append(timestamps, e.Timestamp)
+						}
+					}
+				}
+			}
+			if !timestamps[0].Before(recovered) || !timestamps[1].Equal(time.Unix(1722513602, 0)) {
+				t.Fatalf("expected the replayed lines to keep their timestamps, got %v", timestamps[:2])
+			}
+			if dropped := counterValue(t, m.droppedEntries.WithLabelValues(c.cfg.URL.Host, "", reasonGeneric)); dropped != 0 {
+				t.Fatalf("expected no dropped entries, got %v", dropped)
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUnmarshalCaddyfileFallback(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`loki {
+		url http://localhost:3100/loki/api/v1/push
+		fallback {
+			output stderr
+			threshold 30s
+			probe_interval 5s
+			replay
+		}
+	}`)
+	l := &LokiLog{}
+	if err := l.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(l.Fallback.WriterRaw) != `{"output":"stderr"}` {
+		t.Fatalf("unexpected writer: %s", l.Fallback.WriterRaw)
+	}
+	if l.Fallback.Threshold.T != 30*time.Second || l.Fallback.ProbeInterval.T != 5*time.Second || !l.Fallback.Replay {
+		t.Fatalf("unexpected fallback: %+v", l.Fallback)
+	}
+
+	// replay is only supported with a file
+	l.Fallback.writerOpener = caddy.StderrWriter{}
+	if err := l.validateFallback(); err == nil || !strings.Contains(err.Error(), "requires the file output") {
+		t.Fatalf("expected replay error, got %v", err)
+	}
+}
@@ -0,0 +1,455 @@
+package caddy_logger_loki
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+	Caddy writes its logs as JSON lines. Before they are sent, their fields can be projected to the included and not
+excluded ones and nested fields flattened, then the line format rewrites them, as JSON, logfmt, in Apache's combined
+log format or with a template. Lines which aren't JSON objects, like console formatted logs, are sent as they are.
+*/
+
+const (
+	lineFormatRaw       = "raw"
+	lineFormatLogfmt    = "logfmt"
+	lineFormatCommonLog = "common_log"
+)
+
+// defaultFlattenSeparator joins the keys of flattened fields like LogQL's json parser.
+const defaultFlattenSeparator = "_"
+
+// commonLogTimeFormat is the time format of Apache's common log format.
+const commonLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+var errNotJSONObject = errors.New("line is not a JSON object")
+
+// lineFormatter rewrites JSON lines into a line format.
+type lineFormatter struct {
+	format string
+	// set for a template line format
+	template *template.Template
+	// paths of the included and excluded fields, split into their keys
+	include [][]string
+	exclude [][]string
+	// separator nested fields are flattened with, empty to not flatten
+	separator string
+}
+
+/*
+newLineFormatter returns the formatter of format, projecting the fields of lines to the include and exclude paths and
+flattening them with separator, if not empty. It returns nil for raw lines without projection and flattening. Any
+format other than raw, logfmt and common_log is parsed as template, which needs an action, so a misspelled format
+isn't sent as the line of every entry.
+*/
+func newLineFormatter(format string, include, exclude []string, separator string) (*lineFormatter, error) {
+	f := &lineFormatter{format: format, separator: separator}
+	switch format {
+	case "":
+		f.format = lineFormatRaw
+	case lineFormatRaw, lineFormatLogfmt, lineFormatCommonLog:
+	default:
+		if !strings.Contains(format, "{{") {
+			return nil, fmt.Errorf("line_format %q is neither %s, %s, %s nor a template with an action like {{.msg}}", format, lineFormatRaw, lineFormatLogfmt, lineFormatCommonLog)
+		}
+		tmpl, err := template.New("line_format").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("line_format is neither %s, %s, %s nor a valid template: %v", lineFormatRaw, lineFormatLogfmt, lineFormatCommonLog, err)
+		}
+		f.format, f.template = "", tmpl
+	}
+
+	var err error
+	if f.include, err = parseFieldPaths(include); err != nil {
+		return nil, fmt.Errorf("include_fields is invalid: %v", err)
+	}
+	if f.exclude, err = parseFieldPaths(exclude); err != nil {
+		return nil, fmt.Errorf("exclude_fields is invalid: %v", err)
+	}
+
+	if f.format == lineFormatRaw && len(f.include) == 0 && len(f.exclude) == 0 && f.separator == "" {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// parseFieldPaths splits paths into their keys, separated by dots. Keys are matched as patterns of path.Match.
+func parseFieldPaths(paths []string) ([][]string, error) {
+	parsed := make([][]string, 0, len(paths))
+	for _, p := range paths {
+		keys := strings.Split(p, ".")
+		for _, key := range keys {
+			if key == "" {
+				return nil, fmt.Errorf("path %q has an empty key", p)
+			}
+			if _, err := path.Match(key, ""); err != nil {
+				return nil, fmt.Errorf("path %q has an invalid pattern %q: %v", p, key, err)
+			}
+		}
+		parsed = append(parsed, keys)
+	}
+	return parsed, nil
+}
+
+/*
+formatLine returns line in the line format. Lines which aren't JSON objects, access logs without request for
+common_log and lines the template fails for are returned as they are.
+*/
+func (f *lineFormatter) formatLine(line []byte) []byte {
+	fields, err := parseFields(line)
+	if err != nil {
+		return line
+	}
+	if len(f.include) > 0 || len(f.exclude) > 0 {
+		fields = f.project(fields, nil, len(f.include) == 0)
+	}
+	if f.separator != "" {
+		fields = flattenFields(nil, "", f.separator, fields)
+	}
+
+	switch f.format {
+	case lineFormatRaw:
+		return appendJSON(nil, fields)
+	case lineFormatLogfmt:
+		return appendLogfmt(nil, "", fields)
+	case lineFormatCommonLog:
+		if formatted, ok := commonLog(fieldsMap(fields)); ok {
+			return formatted
+		}
+		return line
+	}
+	var buf bytes.Buffer
+	if err := f.template.Execute(&buf, fieldsMap(fields)); err != nil {
+		return line
+	}
+	return buf.Bytes()
+}
+
+// pathMatch is how a path of a field matches a path pattern.
+type pathMatch int
+
+const (
+	pathNone pathMatch = iota
+	// the field is an ancestor of the fields matching the pattern
+	pathAncestor
+	// the field, or one of its ancestors, matches the pattern
+	pathFull
+)
+
+// matchPaths returns the best match of the path of a field with patterns.
+func matchPaths(patterns [][]string, keys []string) pathMatch {
+	match := pathNone
+	for _, pattern := range patterns {
+		n := len(pattern)
+		if len(keys) < n {
+			n = len(keys)
+		}
+		matched := true
+		for i := 0; i < n && matched; i++ {
+			matched, _ = path.Match(pattern[i], keys[i])
+		}
+		switch {
+		case !matched:
+		case len(keys) >= len(pattern):
+			return pathFull
+		default:
+			match = pathAncestor
+		}
+	}
+	return match
+}
+
+/*
+project returns the included and not excluded fields of an object at the path keys. Objects which are ancestors of
+included fields keep only them, and are removed if none remain. included is set if the object is included as a whole.
+*/
+func (f *lineFormatter) project(fields []field, keys []string, included bool) []field {
+	projected := make([]field, 0, len(fields))
+	for _, fd := range fields {
+		fieldKeys := append(keys[:len(keys):len(keys)], fd.key)
+		if matchPaths(f.exclude, fieldKeys) == pathFull {
+			continue
+		}
+		fieldIncluded := included
+		if !included {
+			switch matchPaths(f.include, fieldKeys) {
+			case pathNone:
+				continue
+			case pathFull:
+				fieldIncluded = true
+			}
+		}
+		if object, ok := fd.value.([]field); ok {
+			object = f.project(object, fieldKeys, fieldIncluded)
+			if !fieldIncluded && len(object) == 0 {
+				continue
+			}
+			fd.value = object
+		} else if !fieldIncluded {
+			continue
+		}
+		projected = append(projected, fd)
+	}
+	return projected
+}
+
+// flattenFields appends fields to flattened, nested fields get the keys of their ancestors joined by separator.
+func flattenFields(flattened []field, prefix, separator string, fields []field) []field {
+	for _, fd := range fields {
+		if object, ok := fd.value.([]field); ok {
+			flattened = flattenFields(flattened, prefix+fd.key+separator, separator, object)
+			continue
+		}
+		flattened = append(flattened, field{key: prefix + fd.key, value: fd.value})
+	}
+	return flattened
+}
+
+// field is a field of a JSON object. The value of an object is []field, of an array []any and of a number json.Number.
+type field struct {
+	key   string
+	value any
+}
+
+// parseFields parses a JSON object into its fields, keeping their order.
+func parseFields(line []byte) ([]field, error) {
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t != json.Delim('{') {
+		return nil, errNotJSONObject
+	}
+	fields, err := decodeObject(d)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errNotJSONObject
+	}
+	return fields, nil
+}
+
+// decodeObject decodes the fields of an object, after its opening brace.
+func decodeObject(d *json.Decoder) ([]field, error) {
+	fields := []field{}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		// the decoder only returns strings as keys
+		key := t.(string)
+		value, err := decodeValue(d)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field{key: key, value: value})
+	}
+	// the closing brace
+	_, err := d.Token()
+	return fields, err
+}
+
+func decodeValue(d *json.Decoder) (any, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		return decodeObject(d)
+	case json.Delim('['):
+		values := []any{}
+		for d.More() {
+			value, err := decodeValue(d)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		_, err := d.Token()
+		return values, err
+	}
+	return t, nil
+}
+
+// fieldsMap converts fields into maps, for templates.
+func fieldsMap(fields []field) map[string]any {
+	m := make(map[string]any, len(fields))
+	for _, f := range fields {
+		m[f.key] = fieldValue(f.value)
+	}
+	return m
+}
+
+func fieldValue(value any) any {
+	switch v := value.(type) {
+	case []field:
+		return fieldsMap(v)
+	case []any:
+		values := make([]any, len(v))
+		for i := range v {
+			values[i] = fieldValue(v[i])
+		}
+		return values
+	}
+	return value
+}
+
+// appendJSON appends value as JSON to buf, objects keep the order of their fields.
+func appendJSON(buf []byte, value any) []byte {
+	switch v := value.(type) {
+	case []field:
+		buf = append(buf, '{')
+		for i, f := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, f.key)
+			buf = append(buf, ':')
+			buf = appendJSON(buf, f.value)
+		}
+		return append(buf, '}')
+	case []any:
+		buf = append(buf, '[')
+		for i := range v {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSON(buf, v[i])
+		}
+		return append(buf, ']')
+	case string:
+		return appendJSONString(buf, v)
+	case json.Number:
+		return append(buf, v...)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	}
+	return append(buf, "null"...)
+}
+
+// appendJSONString appends s as JSON string to buf, without escaping HTML like Caddy's logs.
+func appendJSONString(buf []byte, s string) []byte {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	// strings always encode
+	_ = e.Encode(s)
+	return append(buf, bytes.TrimSuffix(b.Bytes(), []byte("\n"))...)
+}
+
+/*
+appendLogfmt appends fields as logfmt to buf. Nested objects are flattened into keys joined by dots, arrays are
+written as JSON.
+*/
+func appendLogfmt(buf []byte, prefix string, fields []field) []byte {
+	for _, f := range fields {
+		key := prefix + f.key
+		if object, ok := f.value.([]field); ok {
+			buf = appendLogfmt(buf, key+".", object)
+			continue
+		}
+		if len(buf) > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, key...)
+		buf = append(buf, '=')
+		switch v := f.value.(type) {
+		case string:
+			buf = appendLogfmtValue(buf, v)
+		case []any:
+			buf = appendLogfmtValue(buf, string(appendJSON(nil, v)))
+		case nil:
+		default:
+			buf = appendJSON(buf, v)
+		}
+	}
+	return buf
+}
+
+// appendLogfmtValue appends s to buf, quoted if it is empty or contains spaces, quotes, equal signs or control characters.
+func appendLogfmtValue(buf []byte, s string) []byte {
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r == utf8.RuneError {
+			return strconv.AppendQuote(buf, s)
+		}
+	}
+	if s == "" {
+		return append(buf, `""`...)
+	}
+	return append(buf, s...)
+}
+
+/*
+commonLog formats an access log in Apache's combined log format, the common log format with referer and user agent:
+remote_ip - user_id [ts] "method uri proto" status size "referer" "user_agent". It returns false for logs without
+request.
+*/
+func commonLog(fields map[string]any) ([]byte, bool) {
+	request, ok := fields["request"].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	remote := request["client_ip"]
+	if remote == nil {
+		remote = request["remote_ip"]
+	}
+	ts, ok := fieldTimestamp(fields["ts"])
+	if !ok {
+		ts = time.Now()
+	}
+	size := commonLogValue(fields["size"])
+	if size == "0" {
+		size = "-"
+	}
+	var headers map[string]any
+	headers, _ = request["headers"].(map[string]any)
+
+	var b strings.Builder
+	b.WriteString(commonLogValue(remote))
+	b.WriteString(" - ")
+	b.WriteString(commonLogValue(fields["user_id"]))
+	b.WriteString(" [")
+	b.WriteString(ts.UTC().Format(commonLogTimeFormat))
+	b.WriteString("] ")
+	b.WriteString(strconv.Quote(fmt.Sprintf("%v %v %v", request["method"], request["uri"], request["proto"])))
+	b.WriteString(" ")
+	b.WriteString(commonLogValue(fields["status"]))
+	b.WriteString(" ")
+	b.WriteString(size)
+	b.WriteString(" ")
+	b.WriteString(strconv.Quote(commonLogValue(headerValue(headers, "Referer"))))
+	b.WriteString(" ")
+	b.WriteString(strconv.Quote(commonLogValue(headerValue(headers, "User-Agent"))))
+	return []byte(b.String()), true
+}
+
+// commonLogValue returns value as string, or - if it is missing or empty.
+func commonLogValue(value any) string {
+	if value == nil || value == "" {
+		return "-"
+	}
+	return fmt.Sprint(value)
+}
+
+// headerValue returns the first value of a header logged by Caddy, as list of values.
+func headerValue(headers map[string]any, name string) any {
+	if values, ok := headers[name].([]any); ok && len(values) > 0 {
+		return values[0]
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package caddy_logger_loki
+
+import (
+	"testing"
+)
+
+// accessLog is an access log line as written by Caddy.
+const accessLog = `{"level":"info","ts":1722513600.5,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"10.0.0.1","client_ip":"203.0.113.7","proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/search?q=\"loki\"","headers":{"User-Agent":["curl/8.5.0"],"Referer":["https://example.com/"]}},"user_id":"","duration":0.0012,"size":1024,"status":200}`
+
+func TestLineFormatter(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		line     string
+		expected string
+	}{
+		{
+			name:     "logfmt",
+			format:   "logfmt",
+			line:     `{"level":"info","ts":1722513600.5,"msg":"handled request","request":{"method":"GET","headers":{"Accept":["*/*","text/html"]}},"empty":"","nil":null,"ok":true}`,
+			expected: `level=info ts=1722513600.5 msg="handled request" request.method=GET request.headers.Accept="[\"*/*\",\"text/html\"]" empty="" nil= ok=true`,
+		},
+		{
+			name:     "common log",
+			format:   "common_log",
+			line:     accessLog,
+			expected: `203.0.113.7 - - [01/Aug/2024:12:00:00 +0000] "GET /search?q=\"loki\" HTTP/2.0" 200 1024 "https://example.com/" "curl/8.5.0"`,
+		},
+		{
+			name:     "common log without request",
+			format:   "common_log",
+			line:     `{"level":"info","msg":"serving initial configuration"}`,
+			expected: `{"level":"info","msg":"serving initial configuration"}`,
+		},
+		{
+			name:     "common log without headers",
+			format:   "common_log",
+			line:     `{"ts":1722513600,"request":{"remote_ip":"10.0.0.1","proto":"HTTP/1.1","method":"HEAD","uri":"/"},"user_id":"alice","size":0,"status":204}`,
+			expected: `10.0.0.1 - alice [01/Aug/2024:12:00:00 +0000] "HEAD / HTTP/1.1" 204 - "-" "-"`,
+		},
+		{
+			name:     "template",
+			format:   `{{.request.method}} {{.request.uri}} {{.status}} {{index .request.headers "User-Agent" 0}}`,
+			line:     accessLog,
+			expected: `GET /search?q="loki" 200 curl/8.5.0`,
+		},
+		{
+			name:     "template failing",
+			format:   `{{index .request.headers "User-Agent" 1}}`,
+			line:     accessLog,
+			expected: accessLog,
+		},
+		{
+			name:     "not json",
+			format:   "logfmt",
+			line:     "2024/08/01 12:00:00 console log",
+			expected: "2024/08/01 12:00:00 console log",
+		},
+		{
+			name:     "trailing data",
+			format:   "logfmt",
+			line:     `{"msg":"a"} {"msg":"b"}`,
+			expected: `{"msg":"a"} {"msg":"b"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := newLineFormatter(test.format, nil, nil, "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if formatted := string(f.formatLine([]byte(test.line))); formatted != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, formatted)
+			}
+		})
+	}
+}
+
+func TestNewLineFormatter(t *testing.T) {
+	for _, format := range []string{"", "raw"} {
+		if f, err := newLineFormatter(format, nil, nil, ""); f != nil || err != nil {
+			t.Fatalf("expected no formatter for %q, got %v, %v", format, f, err)
+		}
+	}
+	if _, err := newLineFormatter("{{.msg", nil, nil, ""); err == nil {
+		t.Fatalf("expected an error for an invalid template")
+	}
+	for _, format := range []string{"json", "logfmtt", "msg"} {
+		if _, err := newLineFormatter(format, nil, nil, ""); err == nil {
+			t.Fatalf("expected an error for %q, which has no template action", format)
+		}
+	}
+	if _, err := newLineFormatter("", []string{"request..uri"}, nil, ""); err == nil {
+		t.Fatalf("expected an error for an empty key")
+	}
+	if _, err := newLineFormatter("", nil, []string{"request.headers.[a"}, ""); err == nil {
+		t.Fatalf("expected an error for an invalid pattern")
+	}
+}
+
+func TestProjectFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		separator string
+		format    string
+		expected  string
+	}{
+		{
+			name:     "include",
+			include:  []string{"msg", "request.method", "request.headers.User-*", "status"},
+			expected: `{"msg":"handled request","request":{"method":"GET","headers":{"User-Agent":["curl/8.5.0"]}},"status":200}`,
+		},
+		{
+			name:     "include object",
+			include:  []string{"request.headers"},
+			expected: `{"request":{"headers":{"User-Agent":["curl/8.5.0"],"Referer":["https://example.com/"]}}}`,
+		},
+		{
+			name:     "include without match",
+			include:  []string{"request.tls.*"},
+			expected: `{}`,
+		},
+		{
+			name:     "exclude",
+			exclude:  []string{"request.headers", "*_id", "duration"},
+			expected: `{"level":"info","ts":1722513600.5,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"10.0.0.1","client_ip":"203.0.113.7","proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/search?q=\"loki\""},"size":1024,"status":200}`,
+		},
+		{
+			name:     "include and exclude",
+			include:  []string{"request"},
+			exclude:  []string{"request.*_ip", "request.headers.Referer"},
+			expected: `{"request":{"proto":"HTTP/2.0","method":"GET","host":"example.com","uri":"/search?q=\"loki\"","headers":{"User-Agent":["curl/8.5.0"]}}}`,
+		},
+		{
+			name:      "flatten",
+			include:   []string{"msg", "request.method", "request.headers"},
+			separator: "_",
+			expected:  `{"msg":"handled request","request_method":"GET","request_headers_User-Agent":["curl/8.5.0"],"request_headers_Referer":["https://example.com/"]}`,
+		},
+		{
+			name:      "flatten logfmt",
+			include:   []string{"request.method", "status"},
+			separator: ":",
+			format:    "logfmt",
+			expected:  `request:method=GET status=200`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := newLineFormatter(test.format, test.include, test.exclude, test.separator)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if formatted := string(f.formatLine([]byte(accessLog))); formatted != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, formatted)
+			}
+		})
+	}
+}
+
+func TestAppendJSON(t *testing.T) {
+	line := `{"msg":"<a> & \"b\"","n":1.50,"list":[{"b":1,"a":null},false],"obj":{}}`
+	fields, err := parseFields([]byte(line))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if encoded := string(appendJSON(nil, fields)); encoded != line {
+		t.Fatalf("expected %s, got %s", line, encoded)
+	}
+}
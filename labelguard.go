@@ -0,0 +1,122 @@
+package caddy_logger_loki
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	Every distinct label value creates a stream, so a misconfigured placeholder label can create thousands of them,
+which the client only limits by dropping entries once max_streams is reached. The labels of a writer are fixed once
+their placeholders are replaced, so the label guard limits their values when the writer is opened: values which aren't
+allowed, or exceed the maximum number of distinct values of their label among the loki writers of the config, are
+replaced by the overflow value, so their entries are kept in a single stream. Caddy opens one writer per loki log, so
+the values are shared by every loki log provisioned by the same config load, and released once it is unloaded.
+*/
+
+// LabelGuard limits the values of labels.
+type LabelGuard struct {
+	/*
+		Values allowed per label, other values are rejected. Labels without list allow any value. Every label must be
+		configured in labels, with sanitize_labels its name is sanitized like the label's.
+		Example: {"env": ["prod", "staging"]}
+	*/
+	AllowedValues map[string][]string `json:"allowed_values,omitempty"`
+
+	/*
+		Maximum number of distinct values per label, further values are rejected. The values are counted across the
+		loki writers of the config, like the sites each logging to loki with a label of their own, and counted anew
+		when the config is reloaded. 0 means no limit, default is 0.
+	*/
+	MaxValues int `json:"max_values,omitempty"`
+
+	// Value rejected label values are replaced with, e.g. other. Without it, labels with rejected values are removed.
+	Overflow string `json:"overflow,omitempty"`
+}
+
+// labelValues are the distinct values of labels seen by a label guard.
+type labelValues struct {
+	mu     sync.Mutex
+	values map[string]map[string]struct{}
+}
+
+func newLabelValues() *labelValues {
+	return &labelValues{values: map[string]map[string]struct{}{}}
+}
+
+// Destruct implements caddy.Destructor, the values are released with the config load they are counted for.
+func (v *labelValues) Destruct() error {
+	return nil
+}
+
+// labelValuesPool holds the label values of every config load, keyed by its context.
+var labelValuesPool = caddy.NewUsagePool()
+
+// loadLabelValues returns the label values counted for the config load of ctx, Release them with labelValuesPool.Delete.
+func loadLabelValues(ctx caddy.Context) *labelValues {
+	values, _, _ := labelValuesPool.LoadOrNew(ctx.Context, func() (caddy.Destructor, error) {
+		return newLabelValues(), nil
+	})
+	return values.(*labelValues)
+}
+
+// add adds value to the values of label, if it is seen already or label has less than max values, 0 means no limit.
+func (v *labelValues) add(label, value string, max int) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values, ok := v.values[label]
+	if !ok {
+		values = map[string]struct{}{}
+		v.values[label] = values
+	}
+	if _, ok := values[value]; ok {
+		return true
+	}
+	if max > 0 && len(values) >= max {
+		return false
+	}
+	values[value] = struct{}{}
+	return true
+}
+
+/*
+guardLabels returns labels with the values g rejects replaced by the overflow value, or removed without it.
+Reserved labels, like __tenant_id__, aren't stream labels and are kept. Rejected values are counted in rejected, by
+label and reason.
+*/
+func guardLabels(g *LabelGuard, seen *labelValues, labels map[string]string, rejected *prometheus.CounterVec) map[string]string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	// sorted, so the values counted first don't depend on the order of the map
+	sort.Strings(names)
+
+	guarded := make(map[string]string, len(labels))
+	for _, name := range names {
+		value := labels[name]
+		reason := ""
+		switch allowed, ok := g.AllowedValues[name]; {
+		case strings.HasPrefix(name, "__") || value == g.Overflow:
+			// reserved labels and the overflow value are always kept
+		case ok && !slices.Contains(allowed, value):
+			reason = reasonNotAllowed
+		case !seen.add(name, value, g.MaxValues):
+			reason = reasonMaxValues
+		}
+
+		if reason == "" {
+			guarded[name] = value
+			continue
+		}
+		rejected.WithLabelValues(name, reason).Inc()
+		if g.Overflow != "" {
+			guarded[name] = g.Overflow
+		}
+	}
+	return guarded
+}
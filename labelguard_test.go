@@ -0,0 +1,197 @@
+package caddy_logger_loki
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGuardLabels(t *testing.T) {
+	guard := &LabelGuard{
+		AllowedValues: map[string][]string{"env": {"prod", "staging"}},
+		MaxValues:     2,
+		Overflow:      "other",
+	}
+	tests := []struct {
+		name     string
+		guard    *LabelGuard
+		labels   []map[string]string
+		expected map[string]string
+		rejected map[string]float64
+	}{
+		{
+			name:     "allowed",
+			guard:    guard,
+			labels:   []map[string]string{{"env": "prod", "host": "a"}},
+			expected: map[string]string{"env": "prod", "host": "a"},
+		},
+		{
+			name:     "not allowed",
+			guard:    guard,
+			labels:   []map[string]string{{"env": "dev", "host": "a"}},
+			expected: map[string]string{"env": "other", "host": "a"},
+			rejected: map[string]float64{"env/" + reasonNotAllowed: 1},
+		},
+		{
+			name:     "max values",
+			guard:    guard,
+			labels:   []map[string]string{{"host": "a"}, {"host": "b"}, {"host": "a"}, {"host": "c"}},
+			expected: map[string]string{"host": "other"},
+			rejected: map[string]float64{"host/" + reasonMaxValues: 1},
+		},
+		{
+			name:     "overflow value",
+			guard:    guard,
+			labels:   []map[string]string{{"host": "a"}, {"host": "b"}, {"host": "other"}},
+			expected: map[string]string{"host": "other"},
+		},
+		{
+			name:     "reserved label",
+			guard:    &LabelGuard{MaxValues: 1},
+			labels:   []map[string]string{{"__tenant_id__": "a"}, {"__tenant_id__": "b", "job": "caddy"}},
+			expected: map[string]string{"__tenant_id__": "b", "job": "caddy"},
+		},
+		{
+			name:     "without overflow",
+			guard:    &LabelGuard{MaxValues: 1},
+			labels:   []map[string]string{{"host": "a"}, {"host": "b", "job": "caddy"}},
+			expected: map[string]string{"job": "caddy"},
+			rejected: map[string]float64{"host/" + reasonMaxValues: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := newLabelValues()
+			m := newMetrics(prometheus.NewRegistry())
+			rejected := m.rejectedLabels.MustCurryWith(prometheus.Labels{"host": "localhost"})
+			var guarded map[string]string
+			for _, labels := range test.labels {
+				guarded = guardLabels(test.guard, seen, labels, rejected)
+			}
+			if !reflect.DeepEqual(guarded, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, guarded)
+			}
+			for _, label := range []string{"env", "host"} {
+				for _, reason := range []string{reasonNotAllowed, reasonMaxValues} {
+					if value := counterValue(t, rejected.WithLabelValues(label, reason)); value != test.rejected[label+"/"+reason] {
+						t.Fatalf("expected %v rejected values of %s for %s, got %v", test.rejected[label+"/"+reason], label, reason, value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUnmarshalCaddyfileLabelGuard(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`loki {
+		url http://localhost:3100/loki/api/v1/push
+		label_guard {
+			allowed_values env prod staging
+			allowed_values env dev
+			max_values 10
+			overflow other
+		}
+	}`)
+	l := &LokiLog{}
+	if err := l.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &LabelGuard{AllowedValues: map[string][]string{"env": {"prod", "staging", "dev"}}, MaxValues: 10, Overflow: "other"}
+	if !reflect.DeepEqual(l.LabelGuard, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, l.LabelGuard)
+	}
+}
+
+// TestLabelGuardScope checks the distinct values are counted per config, not across configs with the same labels.
+func TestLabelGuardScope(t *testing.T) {
+	s := &testServer{}
+	url := s.start(t)
+	// provision provisions a loki log of the config load of ctx, like a site logging to loki with a label of its own
+	provision := func(ctx caddy.Context, env string) *LokiLog {
+		l := &LokiLog{
+			Url:        url,
+			Labels:     map[string]string{"env": env},
+			LabelGuard: &LabelGuard{MaxValues: 1, Overflow: "other"},
+		}
+		if err := l.Provision(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := l.Validate(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() { _ = l.Cleanup() })
+		return l
+	}
+	open := func(l *LokiLog) model.LabelSet {
+		w, err := l.OpenWriter()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		t.Cleanup(func() { _ = w.Close() })
+		return w.(*LokiWriter).lbs
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	a, b := provision(ctx, "a"), provision(ctx, "b")
+	if lbs := open(a); lbs["env"] != "a" {
+		t.Fatalf("expected env a, got %v", lbs)
+	}
+	if lbs := open(b); lbs["env"] != "other" {
+		t.Fatalf("expected the second value of the config load to be rejected, got %v", lbs)
+	}
+
+	// the config after a reload has values of its own
+	reloaded, cancelReloaded := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancelReloaded()
+	if lbs := open(provision(reloaded, "b")); lbs["env"] != "b" {
+		t.Fatalf("expected env b after the reload, got %v", lbs)
+	}
+
+	// the values are released once every loki log of the config load is cleaned up
+	_ = a.Cleanup()
+	if refs, ok := labelValuesPool.References(ctx.Context); !ok || refs != 1 {
+		t.Fatalf("expected 1 reference left, got %d, %v", refs, ok)
+	}
+	_ = b.Cleanup()
+	if _, ok := labelValuesPool.References(ctx.Context); ok {
+		t.Fatalf("expected the values to be released")
+	}
+}
+
+// countingOpener is a fallback writer module counting the writers it opens.
+type countingOpener struct {
+	caddy.StderrWriter
+	opened int
+}
+
+func (o *countingOpener) OpenWriter() (io.WriteCloser, error) {
+	o.opened++
+	return o.StderrWriter.OpenWriter()
+}
+
+func TestLabelGuardRejectsAllLabels(t *testing.T) {
+	opener := &countingOpener{}
+	l := &LokiLog{
+		Url:        "http://localhost:3100",
+		Labels:     map[string]string{"env": "dev"},
+		LabelGuard: &LabelGuard{AllowedValues: map[string][]string{"env": {"prod"}}},
+		Fallback:   &Fallback{writerOpener: opener},
+	}
+	if err := l.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := l.OpenWriter(); err == nil || !strings.Contains(err.Error(), "rejected all labels") {
+		t.Fatalf("expected all labels to be rejected, got %v", err)
+	}
+	if opener.opened != 0 {
+		t.Fatalf("expected no fallback writer to be left open, got %d", opener.opened)
+	}
+}
@@ -0,0 +1,160 @@
+package caddy_logger_loki
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+	Loki rejects every push request with a stream label it can't accept, so the labels are checked when the config
+is loaded instead. With sanitize_labels, invalid label names are rewritten, reserved labels removed and label values
+truncated to Loki's default limits.
+*/
+
+const (
+	// Loki's default max_label_name_length
+	maxLabelNameLength = 1024
+	// Loki's default max_label_value_length
+	maxLabelValueLength = 2048
+)
+
+// labelNameRegexp matches the label names Loki accepts.
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkLabelName returns why Loki doesn't accept name as label, or an empty string if it does.
+func checkLabelName(name string) string {
+	switch {
+	case name == reservedLabelTenantID:
+		return ""
+	case strings.HasPrefix(name, "__"):
+		return "is reserved, names starting with __ are reserved for Loki's internal use"
+	case len(name) > maxLabelNameLength:
+		return fmt.Sprintf("is longer than %d bytes", maxLabelNameLength)
+	case !labelNameRegexp.MatchString(name):
+		return "has invalid characters, it must match " + labelNameRegexp.String()
+	}
+	return ""
+}
+
+/*
+sanitizeLabelName rewrites name into a name Loki accepts: invalid characters are replaced by underscores and a
+leading digit is prefixed with one. It returns an empty string for reserved names, except __tenant_id__.
+*/
+func sanitizeLabelName(name string) string {
+	if name == reservedLabelTenantID {
+		return name
+	}
+	if strings.HasPrefix(name, "__") {
+		return ""
+	}
+
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	sanitized := b.String()
+	// invalid characters may have made the name look reserved
+	if strings.HasPrefix(sanitized, "__") {
+		sanitized = "_" + strings.TrimLeft(sanitized, "_")
+	}
+	if len(sanitized) > maxLabelNameLength {
+		sanitized = sanitized[:maxLabelNameLength]
+	}
+	return sanitized
+}
+
+// sanitizeLabelValue truncates value to Loki's maximum label value length.
+func sanitizeLabelValue(value string) string {
+	return truncateUTF8(value, maxLabelValueLength)
+}
+
+// validateLabels checks the names and values of the labels, or sanitizes them if sanitize_labels is set.
+func (l *LokiLog) validateLabels() error {
+	names := make([]string, 0, len(l.Labels))
+	for name := range l.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if !l.SanitizeLabels {
+		for _, name := range names {
+			if reason := checkLabelName(name); reason != "" {
+				return fmt.Errorf("label name %q %s, set sanitize_labels to rewrite it", name, reason)
+			}
+			if len(l.Labels[name]) > maxLabelValueLength {
+				return fmt.Errorf("value of label %q is longer than %d bytes, set sanitize_labels to truncate it", name, maxLabelValueLength)
+			}
+		}
+		return l.validateLabelGuard()
+	}
+
+	sanitized := make(map[string]string, len(l.Labels))
+	// the label each sanitized name was rewritten from
+	origins := make(map[string]string, len(l.Labels))
+	for _, name := range names {
+		s := sanitizeLabelName(name)
+		if s == "" {
+			l.logger.logger.Warn("removing reserved label", zap.String("label", name))
+			continue
+		}
+		if origin, ok := origins[s]; ok {
+			return fmt.Errorf("labels %q and %q are both sanitized to %q", origin, name, s)
+		}
+		if s != name {
+			l.logger.logger.Warn("rewriting invalid label name", zap.String("label", name), zap.String("sanitized", s))
+		}
+		origins[s] = name
+		sanitized[s] = sanitizeLabelValue(l.Labels[name])
+	}
+	if len(sanitized) == 0 {
+		return fmt.Errorf("sanitize_labels removed all labels, at least one label is required")
+	}
+	l.Labels = sanitized
+
+	// the allowed values of the label guard are looked up by the sanitized names
+	if g := l.LabelGuard; g != nil && g.AllowedValues != nil {
+		guarded := make([]string, 0, len(g.AllowedValues))
+		for name := range g.AllowedValues {
+			guarded = append(guarded, name)
+		}
+		sort.Strings(guarded)
+		allowed := make(map[string][]string, len(g.AllowedValues))
+		for _, name := range guarded {
+			s := sanitizeLabelName(name)
+			allowed[s] = append(allowed[s], g.AllowedValues[name]...)
+		}
+		g.AllowedValues = allowed
+	}
+	return l.validateLabelGuard()
+}
+
+// validateLabelGuard checks that the allowed values of the label guard are for configured labels.
+func (l *LokiLog) validateLabelGuard() error {
+	if l.LabelGuard == nil {
+		return nil
+	}
+	names := make([]string, 0, len(l.LabelGuard.AllowedValues))
+	for name := range l.LabelGuard.AllowedValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := l.Labels[name]; !ok {
+			return fmt.Errorf("label_guard has allowed values for %q, which is not a label", name)
+		}
+	}
+	return nil
+}
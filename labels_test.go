@@ -0,0 +1,147 @@
+package caddy_logger_loki
+
+import (
+	"go.uber.org/zap"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeLabelName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"job", "job"},
+		{"my-label", "my_label"},
+		{"http.host", "http_host"},
+		{"1st", "_1st"},
+		{"größe", "gr__e"},
+		{"__tenant_id__", "__tenant_id__"},
+		{"__name__", ""},
+		{"-_host", "_host"},
+		{strings.Repeat("a", 2000), strings.Repeat("a", maxLabelNameLength)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sanitized := sanitizeLabelName(test.name)
+			if sanitized != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, sanitized)
+			}
+			if sanitized != "" && checkLabelName(sanitized) != "" {
+				t.Fatalf("expected %q to be valid, got: %s", sanitized, checkLabelName(sanitized))
+			}
+		})
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	if value := sanitizeLabelValue("caddy"); value != "caddy" {
+		t.Fatalf("expected the value as it is, got %q", value)
+	}
+	// é is 2 bytes, so the value can't be cut at the limit
+	value := sanitizeLabelValue("a" + strings.Repeat("é", maxLabelValueLength))
+	if len(value) != maxLabelValueLength-1 || !strings.HasSuffix(value, "é") {
+		t.Fatalf("expected the value truncated at a rune boundary, got %d bytes", len(value))
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		sanitize bool
+		// allowed values of the label guard
+		allowed  map[string][]string
+		expected map[string]string
+		// allowed values after validation
+		expectedAllowed map[string][]string
+		err             string
+	}{
+		{
+			name:     "valid",
+			labels:   map[string]string{"job": "caddy", "__tenant_id__": "a"},
+			expected: map[string]string{"job": "caddy", "__tenant_id__": "a"},
+		},
+		{
+			name:   "invalid name",
+			labels: map[string]string{"job": "caddy", "my-label": "a"},
+			err:    `label name "my-label" has invalid characters`,
+		},
+		{
+			name:   "reserved name",
+			labels: map[string]string{"__name__": "caddy"},
+			err:    `label name "__name__" is reserved`,
+		},
+		{
+			name:   "value too long",
+			labels: map[string]string{"job": strings.Repeat("a", maxLabelValueLength+1)},
+			err:    `value of label "job" is longer than 2048 bytes`,
+		},
+		{
+			name:     "sanitized",
+			labels:   map[string]string{"my-label": "a", "__name__": "b", "job": strings.Repeat("a", maxLabelValueLength+1)},
+			sanitize: true,
+			expected: map[string]string{"my_label": "a", "job": strings.Repeat("a", maxLabelValueLength)},
+		},
+		{
+			name:     "sanitized to the same name",
+			labels:   map[string]string{"my-label": "a", "my.label": "b"},
+			sanitize: true,
+			err:      `labels "my-label" and "my.label" are both sanitized to "my_label"`,
+		},
+		{
+			name:            "label guard",
+			labels:          map[string]string{"env": "prod"},
+			allowed:         map[string][]string{"env": {"prod"}},
+			expected:        map[string]string{"env": "prod"},
+			expectedAllowed: map[string][]string{"env": {"prod"}},
+		},
+		{
+			name:    "label guard without label",
+			labels:  map[string]string{"env": "prod"},
+			allowed: map[string][]string{"environment": {"prod"}},
+			err:     `label_guard has allowed values for "environment", which is not a label`,
+		},
+		{
+			name:            "label guard sanitized",
+			labels:          map[string]string{"my-env": "prod"},
+			sanitize:        true,
+			allowed:         map[string][]string{"my-env": {"prod"}, "my.env": {"staging"}},
+			expected:        map[string]string{"my_env": "prod"},
+			expectedAllowed: map[string][]string{"my_env": {"prod", "staging"}},
+		},
+		{
+			name:     "all labels removed",
+			labels:   map[string]string{"__name__": "a"},
+			sanitize: true,
+			err:      "sanitize_labels removed all labels",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := &LokiLog{Labels: test.labels, SanitizeLabels: test.sanitize, logger: newLogger(zap.NewNop())}
+			if test.allowed != nil {
+				l.LabelGuard = &LabelGuard{AllowedValues: test.allowed}
+			}
+			err := l.validateLabels()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(l.Labels, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, l.Labels)
+			}
+			if l.LabelGuard != nil && !reflect.DeepEqual(l.LabelGuard.AllowedValues, test.expectedAllowed) {
+				t.Fatalf("expected allowed values %v, got %v", test.expectedAllowed, l.LabelGuard.AllowedValues)
+			}
+		})
+	}
+}
@@ -1,16 +1,20 @@
 package caddy_logger_loki
 
 import (
+	"context"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	"github.com/grafana/dskit/backoff"
-	"github.com/grafana/dskit/flagext"
-	"github.com/grafana/loki/v3/clients/pkg/promtail/client"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/config"
+	"go.uber.org/zap"
 	"io"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,7 +29,7 @@ type LokiLog struct {
 	/*
 	  The URL where Loki is listening, denoted in Loki as http_listen_address and
 	  http_listen_port. If Loki is running in microservices mode, this is the HTTP
-	  URL for the Distributor. Path to the push API needs to be included.
+	  URL for the Distributor. If the url has no path, the push path of the backend and protocol is appended.
 	  Example: http://example.com:3100/loki/api/v1/push
 	*/
 	Url string `json:"url,omitempty"`
@@ -46,6 +50,38 @@ type LokiLog struct {
 	*/
 	TenantId string `json:"tenant_id,omitempty"`
 
+	/*
+		Encoding of the push request body, one of:
+		protobuf: snappy-compressed protobuf, as sent by promtail
+		json: Loki's JSON push format, for backends and proxies that only accept JSON
+		json+gzip: Loki's JSON push format, gzip compressed
+		default is protobuf.
+	*/
+	Encoding string `json:"encoding,omitempty"`
+
+	/*
+		Protocol used to push logs, one of:
+		loki: Loki's push API, e.g. http://example.com:3100/loki/api/v1/push
+		otlp: OTLP/HTTP protobuf logs, e.g. Loki's native http://example.com:3100/otlp/v1/logs or any OTLP collector.
+		Labels become resource attributes, fields of JSON lines become attributes, msg the body and level the severity.
+		Only the protobuf encoding can be used with otlp.
+		default is loki.
+	*/
+	Protocol string `json:"protocol,omitempty"`
+
+	/*
+		The Loki-compatible backend logs are pushed to, one of:
+		loki: Grafana Loki
+		grafana_cloud: Grafana Cloud Logs, the tenant is determined by the basic_auth username
+		victorialogs: VictoriaLogs, tenant_id is written as <AccountID>[:<ProjectID>] and sent as AccountID and ProjectID headers
+		It determines the push path appended to an url without path, and settings the backend ignores are warned about.
+		default is loki.
+	*/
+	Backend string `json:"backend,omitempty"`
+
+	// Probe the readiness endpoint of the backend (/ready for Loki) when the config is loaded, and fail if it isn't ready. default is false.
+	VerifyOnStart bool `json:"verify_on_start,omitempty"`
+
 	/*
 	  Maximum amount of time to wait before sending a batch, even if that
 	  batch isn'T full.
@@ -54,15 +90,22 @@ type LokiLog struct {
 	BatchWait StrTimeDuration `json:"batchwait,omitempty"`
 
 	/*
-	  Maximum batch size (in bytes) of logs to accumulate before sending
-	  the batch to Loki.
+	  Maximum batch size of logs to accumulate before sending
+	  the batch to Loki, in bytes or with a unit. Example: 512KiB, 1MB
 	  default = 1048576
 	*/
-	BatchSize int `json:"batchsize,omitempty"`
+	BatchSize StrByteSize `json:"batchsize,omitempty"`
 
 	// If using basic auth, configures the username and password sent.
 	BasicAuth *BasicAuth `json:"basic_auth,omitempty"`
 
+	/*
+		Optional generic Authorization header configuration, sent as "<type> <credentials>".
+		The type defaults to Bearer and can be any custom scheme except Basic.
+		Cannot be used at the same time as basic_auth, oauth2 or bearer_token.
+	*/
+	Authorization *Authorization `json:"authorization,omitempty"`
+
 	// Optional OAuth 2.0 configuration
 	// Cannot be used at the same time as basic_auth or authorization
 	Oauth2 *OAuth2 `json:"oauth2,omitempty"`
@@ -73,12 +116,59 @@ type LokiLog struct {
 	// File containing bearer token to send to the server.
 	BearTokenFile string `json:"bearer_token_file,omitempty"`
 
+	/*
+		Optional AWS Signature Version 4 signing of push requests, e.g. for a Loki behind an AWS API gateway.
+		Cannot be used at the same time as basic_auth, authorization, oauth2 or bearer_token.
+	*/
+	SigV4 *SigV4 `json:"sigv4,omitempty"`
+
 	// HTTP proxy server to use to connect to the server.
 	ProxyURL string `json:"proxy_url,omitempty"`
 
+	// Comma-separated addresses that should not use the proxy, e.g. "localhost,10.0.0.0/8". Requires proxy_url.
+	NoProxy string `json:"no_proxy,omitempty"`
+
+	// Use the proxy from HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables. Cannot be used with proxy_url.
+	ProxyFromEnvironment bool `json:"proxy_from_environment,omitempty"`
+
+	/*
+		Headers sent to the proxy during CONNECT requests, e.g. Proxy-Authorization.
+		Values are treated as secrets.
+		[ <headername>: [<value> ...] ... ]
+	*/
+	ProxyConnectHeader ProxyHeader `json:"proxy_connect_header,omitempty"`
+
 	// If connecting to a TLS server, configures how the TLS authentication handshake will operate.
 	TlsConfig TLSConfig `json:"tls_config,omitempty"`
 
+	/*
+		Dial all connections to this address instead of the url host, written as <network>://<address>.
+		A unix socket can also be set directly in the url, e.g. unix:///run/loki.sock:/loki/api/v1/push
+		Example: unix:///run/loki.sock, tcp://10.0.0.1:3100
+	*/
+	Dial string `json:"dial,omitempty"`
+
+	// Disable HTTP keep-alives, so every request uses a new connection. default is false.
+	DisableKeepAlives bool `json:"disable_keep_alives,omitempty"`
+
+	// Maximum amount of time an idle keep-alive connection remains open, default is 5m.
+	IdleConnTimeout StrTimeDuration `json:"idle_conn_timeout,omitempty"`
+
+	// Maximum number of idle keep-alive connections, default is 20000.
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+
+	// Maximum number of idle keep-alive connections per host, default is 1000.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+
+	// Maximum number of connections per host, including connections in use. 0 means no limit. default is 0.
+	MaxConnsPerHost int `json:"max_conns_per_host,omitempty"`
+
+	// connection level settings of the push transport
+	transport transportConfig
+
+	// encoder of the request body
+	encoder encoder
+
 	/*
 	  Configures how to retry requests to Loki when a request
 	  fails.
@@ -94,6 +184,12 @@ type LokiLog struct {
 	*/
 	DropRateLimitedBatches bool `json:"drop_rate_limited_batches,omitempty"`
 
+	/*
+		Entries Loki rejects for being too old (too far behind, out of order or older than reject_old_samples_max_age)
+		are sent again with the current time as timestamp, instead of being dropped. default is false.
+	*/
+	RestampTooFarBehind bool `json:"restamp_too_far_behind,omitempty"`
+
 	/*
 		Static labels to add to all logs being sent to Loki.
 		Use map like {"foo": "bar"} to add a label foo with
@@ -101,11 +197,25 @@ type LokiLog struct {
 	*/
 	Labels map[string]string `json:"labels,omitempty"`
 
+	/*
+		Limits the values of labels, by allowed values and a maximum number of distinct values per label. The labels
+		are checked when a writer is opened, after their placeholders are replaced. Rejected values are replaced by the
+		overflow value, so a misconfigured label doesn't create thousands of streams.
+	*/
+	LabelGuard *LabelGuard `json:"label_guard,omitempty"`
+
+	/*
+		Rewrite label names Loki doesn't accept instead of failing, invalid characters are replaced by underscores.
+		Reserved labels starting with __ are removed, except __tenant_id__, and label values are truncated to Loki's
+		default limit of 2048 bytes. default is false.
+	*/
+	SanitizeLabels bool `json:"sanitize_labels,omitempty"`
+
 	// Maximum time to wait for a server to respond to a request, default is 10s
 	TimeOut StrTimeDuration `json:"timeout,omitempty"`
 
 	// loki client config
-	clientConfig client.Config
+	clientConfig clientConfig
 
 	/*
 		Limits the max number of active streams.
@@ -117,11 +227,91 @@ type LokiLog struct {
 	MaxStreams int `json:"max_streams,omitempty"`
 
 	// Maximum log line byte size allowed without dropping. Example: 256kb, 2M. 0 to disable. default is 0.
-	MaxLineSize int `json:"max_line_size,omitempty"`
+	MaxLineSize StrByteSize `json:"max_line_size,omitempty"`
 
 	// Whether to truncate lines that exceed max_line_size. No effect if max_line_size is disabled. default is false.
 	MaxLineSizeTruncate bool `json:"max_line_size_truncate,omitempty"`
 
+	/*
+		How lines exceeding max_line_size are truncated, one of:
+		bytes: the line is cut at max_line_size, without splitting a UTF-8 character
+		json: the largest string fields of JSON lines are shortened first, ending with a …[truncated N bytes] marker,
+		so the line stays valid JSON. JSON lines which don't fit with all their strings shortened are dropped as
+		line_too_long, lines which aren't JSON objects are cut at max_line_size.
+		Requires max_line_size_truncate, default is bytes.
+	*/
+	MaxLineSizeTruncateMode string `json:"max_line_size_truncate_mode,omitempty"`
+
+	/*
+		Number of workers batching and pushing logs concurrently. Streams are sharded across the workers, every
+		worker sends its batches one after another, so the entries of a stream keep their order.
+		batchsize and max_streams apply per worker.
+		default is 1.
+	*/
+	Workers int `json:"workers,omitempty"`
+
+	/*
+		Maximum number of batches being pushed at the same time, across all workers. It limits the workers pushing
+		concurrently and must not be higher than workers, since every worker sends one batch at a time.
+		default is workers.
+	*/
+	MaxInflightBatches int `json:"max_inflight_batches,omitempty"`
+
+	/*
+		Writer logs are written to while Loki is unreachable, instead of being dropped once the retries are
+		exhausted. The writer switches back once Loki responds again.
+	*/
+	Fallback *Fallback `json:"fallback,omitempty"`
+
+	/*
+		File entries are written to as JSON lines when they are dropped, with their labels, timestamp and the reason
+		they were dropped for. It is rotated by size. A dead letter file can be pushed again by the loki-repush command.
+	*/
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+
+	/*
+		Joins lines into one entry until a line matching start_pattern begins the next entry, for console formatted
+		logs with stack traces. Without it, every line is an entry of its own.
+	*/
+	Multiline *Multiline `json:"multiline,omitempty"`
+
+	/*
+		Format lines are rewritten into before they are sent, one of:
+		raw: the line as written by Caddy
+		logfmt: the fields of the JSON line as logfmt, nested fields are joined by dots, e.g. request.method=GET
+		common_log: access logs in Apache's combined log format, other logs as they are
+		or a Go text/template over the fields of the JSON line, e.g. {{.request.method}} {{.request.uri}} {{.status}}
+		Templates need at least one action, other values are rejected.
+		Lines which aren't JSON objects are sent as they are. default is raw.
+	*/
+	LineFormat string `json:"line_format,omitempty"`
+
+	/*
+		Paths of the fields of JSON lines to keep, with keys separated by dots and matched as wildcard patterns,
+		e.g. ts, msg, request.method, request.headers.X-*. A path includes the fields nested in it. default keeps all fields.
+	*/
+	IncludeFields []string `json:"include_fields,omitempty"`
+
+	// Paths of the fields of JSON lines to remove, like include_fields, e.g. request.headers, request.tls.
+	ExcludeFields []string `json:"exclude_fields,omitempty"`
+
+	/*
+		Flatten the nested fields of JSON lines, their keys are joined by flatten_separator, e.g. request_method.
+		Applied after include_fields and exclude_fields, before line_format.
+	*/
+	Flatten bool `json:"flatten,omitempty"`
+
+	// Separator the keys of flattened fields are joined with, default is _ like LogQL's json parser.
+	FlattenSeparator string `json:"flatten_separator,omitempty"`
+
+	// formatter of line_format, nil for raw lines
+	lineFormatter *lineFormatter
+
+	// distinct label values of the loki writers of the config load, counted by label_guard
+	labelValues *labelValues
+	// key of labelValues in labelValuesPool, nil if they aren't shared with other loki logs
+	labelValuesKey context.Context
+
 	// inner logger to log module itself log
 	logger logger
 }
@@ -135,6 +325,18 @@ type BackoffConfig struct {
 
 	// Maximum number of retries to do, default is 10
 	MaxRetries int `json:"max_retries,omitempty"`
+
+	/*
+		Fraction every backoff time is randomized by, so instances don't retry at the same time, e.g. 0.2 spreads
+		a backoff time of 10s over 8s to 12s. Must be between 0 and 1, default is 0.
+	*/
+	Jitter float64 `json:"jitter,omitempty"`
+
+	/*
+		Maximum total time spent retrying a batch, it is dropped once the next retry would exceed it. A Retry-After
+		header replaces the backoff time, up to max_period and the time left of max_elapsed. 0 means no limit, default is 0.
+	*/
+	MaxElapsed StrTimeDuration `json:"max_elapsed,omitempty"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -145,12 +347,34 @@ func (l *LokiLog) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// Provision sets up the module, now only init the logger.
+/*
+Provision sets up the module, it inits the logger, loads the fallback writer and the label values shared with the
+other loki logs of the config load.
+*/
 func (l *LokiLog) Provision(ctx caddy.Context) error {
 	l.logger = newLogger(ctx.Logger())
+	if l.Fallback != nil {
+		if err := l.Fallback.provision(ctx); err != nil {
+			return fmt.Errorf("loading fallback writer failed: %v", err)
+		}
+	}
+	if l.LabelGuard != nil {
+		l.labelValues = loadLabelValues(ctx)
+		l.labelValuesKey = ctx.Context
+	}
 	return nil
 }
 
+// Cleanup releases the label values once the config is unloaded.
+func (l *LokiLog) Cleanup() error {
+	if l.labelValuesKey == nil {
+		return nil
+	}
+	_, err := labelValuesPool.Delete(l.labelValuesKey)
+	l.labelValuesKey = nil
+	return err
+}
+
 /*
 UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
 
@@ -160,6 +384,10 @@ UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
 	}
 
 	tenant_id
+	encoding
+	protocol
+	backend
+	verify_on_start
 	batchwait
 	batchsize
 
@@ -170,9 +398,16 @@ UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
 		password_file
 	}
 
+	authorization {
+		type
+		credentials
+		credentials_file
+	}
+
 	oauth2 {
 		client_id
 		client_secret
+		client_secret_file
 		scopes
 		token_url
 		endpoint_params {
@@ -182,27 +417,85 @@ UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
 
 	bearer_token
 	bearer_token_file
+	sigv4 {
+		region
+		access_key
+		secret_key
+		profile
+		role_arn
+		service
+	}
 	proxy_url
+	no_proxy
+	proxy_from_environment
+	proxy_connect_header {
+		key value [value...]
+	}
 	tls_config {
+		ca
 		ca_file
+		cert
 		cert_file
+		key
 		key_file
 		server_name
-		insecure_skip_verify
+		insecure_skip_verify [true|false]
+		min_version
+		max_version
+		cipher_suites name [name...]
+		pin_sha256 hash [hash...]
 	}
+	dial
+	disable_keep_alives
+	idle_conn_timeout
+	max_idle_conns
+	max_idle_conns_per_host
+	max_conns_per_host
 	backoff_config {
 		min_period
 		max_period
 		max_retries
+		jitter
+		max_elapsed
 	}
 	drop_rate_limited_batches
+	restamp_too_far_behind
 	labels {
 		key value
 	}
+	label_guard {
+		allowed_values <label> <value> [<value>...]
+		max_values
+		overflow
+	}
+	sanitize_labels
 	timeout
 	max_streams
 	max_line_size
 	max_line_size_truncate
+	max_line_size_truncate_mode <bytes|json>
+	workers
+	max_inflight_batches
+	fallback {
+		output <writer_module> ...
+		threshold
+		probe_interval
+		replay
+	}
+	dead_letter <filename> {
+		roll_size_mb
+		roll_keep
+		roll_gzip
+	}
+	multiline {
+		start_pattern
+		max_wait
+		max_lines
+	}
+	line_format <raw|logfmt|common_log|template>
+	include_fields <path> [<path>...]
+	exclude_fields <path> [<path>...]
+	flatten [<separator>]
 */
 func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	if !d.NextArg() {
@@ -232,6 +525,23 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			l.TenantId = d.Val()
+		case "encoding":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.Encoding = d.Val()
+		case "protocol":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.Protocol = d.Val()
+		case "backend":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.Backend = d.Val()
+		case "verify_on_start":
+			l.VerifyOnStart = true
 
 		case "batchwait":
 			if !d.NextArg() {
@@ -247,11 +557,10 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			v := d.Val()
-			s, err := strconv.Atoi(v)
+			err := l.BatchSize.FromString(v)
 			if err != nil {
-				return fmt.Errorf("parse batchsize parameter failed, invalid int: %v", err)
+				return fmt.Errorf("parse batchsize parameter failed, invalid byte size: %v", err)
 			}
-			l.BatchSize = s
 		case "basic_auth":
 			l.BasicAuth = &BasicAuth{}
 			for basicAuthBlock := d.Nesting(); d.NextBlock(basicAuthBlock); {
@@ -278,6 +587,27 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					l.BasicAuth.PasswordFile = d.Val()
 				}
 			}
+		case "authorization":
+			l.Authorization = &Authorization{}
+			for authorizationBlock := d.Nesting(); d.NextBlock(authorizationBlock); {
+				switch d.Val() {
+				case "type":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.Authorization.Type = d.Val()
+				case "credentials":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.Authorization.Credentials = Secret(d.Val())
+				case "credentials_file":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.Authorization.CredentialsFile = d.Val()
+				}
+			}
 		case "oauth2":
 			l.Oauth2 = &OAuth2{}
 			for oauth2Block := d.Nesting(); d.NextBlock(oauth2Block); {
@@ -292,6 +622,11 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 						return d.ArgErr()
 					}
 					l.Oauth2.ClientSecret = Secret(d.Val())
+				case "client_secret_file":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.Oauth2.ClientSecretFile = d.Val()
 				case "scopes":
 					if !d.NextArg() {
 						return d.ArgErr()
@@ -330,24 +665,97 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			l.BearTokenFile = d.Val()
+		case "sigv4":
+			l.SigV4 = &SigV4{}
+			for sigV4Block := d.Nesting(); d.NextBlock(sigV4Block); {
+				switch d.Val() {
+				case "region":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.SigV4.Region = d.Val()
+				case "access_key":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.SigV4.AccessKey = d.Val()
+				case "secret_key":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.SigV4.SecretKey = Secret(d.Val())
+				case "profile":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.SigV4.Profile = d.Val()
+				case "role_arn":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.SigV4.RoleARN = d.Val()
+				case "service":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.SigV4.Service = d.Val()
+				}
+			}
 		case "proxy_url":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			l.ProxyURL = d.Val()
+		case "no_proxy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.NoProxy = d.Val()
+		case "proxy_from_environment":
+			l.ProxyFromEnvironment = true
+		case "proxy_connect_header":
+			header := ProxyHeader{}
+			for nestingProxyHeader := d.Nesting(); d.NextBlock(nestingProxyHeader); {
+				key := d.Val()
+
+				values := d.RemainingArgs()
+				if len(values) == 0 {
+					return d.ArgErr()
+				}
+
+				for _, value := range values {
+					header[key] = append(header[key], Secret(value))
+				}
+			}
+			l.ProxyConnectHeader = header
 		case "tls_config":
 			for tlsConfigBlock := d.Nesting(); d.NextBlock(tlsConfigBlock); {
 				switch d.Val() {
+				case "ca":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.TlsConfig.CA = d.Val()
 				case "ca_file":
 					if !d.NextArg() {
 						return d.ArgErr()
 					}
 					l.TlsConfig.CAFile = d.Val()
+				case "cert":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.TlsConfig.Cert = d.Val()
 				case "cert_file":
 					if !d.NextArg() {
 						return d.ArgErr()
 					}
 					l.TlsConfig.CertFile = d.Val()
+				case "key":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.TlsConfig.Key = Secret(d.Val())
 				case "key_file":
 					if !d.NextArg() {
 						return d.ArgErr()
@@ -360,8 +768,91 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					l.TlsConfig.ServerName = d.Val()
 				case "insecure_skip_verify":
 					l.TlsConfig.InsecureSkipVerify = true
+					if d.NextArg() {
+						b, err := strconv.ParseBool(d.Val())
+						if err != nil {
+							return fmt.Errorf("parse insecure_skip_verify parameter failed, invalid bool: %v", err)
+						}
+						l.TlsConfig.InsecureSkipVerify = b
+					}
+				case "min_version":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v, err := parseTLSVersion(d.Val())
+					if err != nil {
+						return fmt.Errorf("parse min_version parameter failed: %v", err)
+					}
+					l.TlsConfig.MinVersion = v
+				case "max_version":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v, err := parseTLSVersion(d.Val())
+					if err != nil {
+						return fmt.Errorf("parse max_version parameter failed: %v", err)
+					}
+					l.TlsConfig.MaxVersion = v
+				case "cipher_suites":
+					suites := d.RemainingArgs()
+					if len(suites) == 0 {
+						return d.ArgErr()
+					}
+					l.TlsConfig.CipherSuites = suites
+				case "pin_sha256":
+					pins := d.RemainingArgs()
+					if len(pins) == 0 {
+						return d.ArgErr()
+					}
+					l.TlsConfig.PinnedSHA256 = pins
 				}
 			}
+		case "dial":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.Dial = d.Val()
+		case "disable_keep_alives":
+			l.DisableKeepAlives = true
+		case "idle_conn_timeout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v := d.Val()
+			err := l.IdleConnTimeout.FromString(v)
+			if err != nil {
+				return fmt.Errorf("parse idle_conn_timeout parameter failed, invalid duration: %v", err)
+			}
+		case "max_idle_conns":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v := d.Val()
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("parse max_idle_conns parameter failed, invalid int: %v", err)
+			}
+			l.MaxIdleConns = i
+		case "max_idle_conns_per_host":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v := d.Val()
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("parse max_idle_conns_per_host parameter failed, invalid int: %v", err)
+			}
+			l.MaxIdleConnsPerHost = i
+		case "max_conns_per_host":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v := d.Val()
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("parse max_conns_per_host parameter failed, invalid int: %v", err)
+			}
+			l.MaxConnsPerHost = i
 		case "backoff_config":
 			for backoffConfigBlock := d.Nesting(); d.NextBlock(backoffConfigBlock); {
 				switch d.Val() {
@@ -393,10 +884,31 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 						return fmt.Errorf("parse max_retries parameter failed, invalid int: %v", err)
 					}
 					l.BackoffConfig.MaxRetries = i
+				case "jitter":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					f, err := strconv.ParseFloat(v, 64)
+					if err != nil {
+						return fmt.Errorf("parse jitter parameter failed, invalid float: %v", err)
+					}
+					l.BackoffConfig.Jitter = f
+				case "max_elapsed":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					err := l.BackoffConfig.MaxElapsed.FromString(v)
+					if err != nil {
+						return fmt.Errorf("parse max_elapsed parameter failed, invalid duration: %v", err)
+					}
 				}
 			}
 		case "drop_rate_limited_batches":
 			l.DropRateLimitedBatches = true
+		case "restamp_too_far_behind":
+			l.RestampTooFarBehind = true
 		case "labels":
 			labels := map[string]string{}
 			for nestingLabels := d.Nesting(); d.NextBlock(nestingLabels); {
@@ -409,6 +921,38 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				labels[key] = d.Val()
 			}
 			l.Labels = labels
+		case "sanitize_labels":
+			l.SanitizeLabels = true
+		case "label_guard":
+			l.LabelGuard = &LabelGuard{}
+			for labelGuardBlock := d.Nesting(); d.NextBlock(labelGuardBlock); {
+				switch d.Val() {
+				case "allowed_values":
+					args := d.RemainingArgs()
+					if len(args) < 2 {
+						return d.ArgErr()
+					}
+					if l.LabelGuard.AllowedValues == nil {
+						l.LabelGuard.AllowedValues = map[string][]string{}
+					}
+					l.LabelGuard.AllowedValues[args[0]] = append(l.LabelGuard.AllowedValues[args[0]], args[1:]...)
+				case "max_values":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					i, err := strconv.Atoi(v)
+					if err != nil {
+						return fmt.Errorf("parse max_values parameter failed, invalid int: %v", err)
+					}
+					l.LabelGuard.MaxValues = i
+				case "overflow":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.LabelGuard.Overflow = d.Val()
+				}
+			}
 		case "max_streams":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -424,13 +968,174 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			v := d.Val()
-			i, err := strconv.Atoi(v)
+			err := l.MaxLineSize.FromString(v)
 			if err != nil {
-				return fmt.Errorf("parse max_line_size parameter failed, invalid int: %v", err)
+				return fmt.Errorf("parse max_line_size parameter failed, invalid byte size: %v", err)
 			}
-			l.MaxLineSize = i
 		case "max_line_size_truncate":
 			l.MaxLineSizeTruncate = true
+		case "max_line_size_truncate_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.MaxLineSizeTruncateMode = d.Val()
+		case "workers":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v := d.Val()
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("parse workers parameter failed, invalid int: %v", err)
+			}
+			l.Workers = i
+		case "max_inflight_batches":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			v := d.Val()
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("parse max_inflight_batches parameter failed, invalid int: %v", err)
+			}
+			l.MaxInflightBatches = i
+		case "fallback":
+			l.Fallback = &Fallback{}
+			for fallbackBlock := d.Nesting(); d.NextBlock(fallbackBlock); {
+				switch d.Val() {
+				case "output":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					moduleName := d.Val()
+
+					// the standard writers have no Caddyfile unmarshaler, like in Caddy's log directive
+					var wo caddy.WriterOpener
+					switch moduleName {
+					case "stdout":
+						wo = caddy.StdoutWriter{}
+					case "stderr":
+						wo = caddy.StderrWriter{}
+					case "discard":
+						wo = caddy.DiscardWriter{}
+					default:
+						modID := "caddy.logging.writers." + moduleName
+						unm, err := caddyfile.UnmarshalModule(d, modID)
+						if err != nil {
+							return err
+						}
+						var ok bool
+						wo, ok = unm.(caddy.WriterOpener)
+						if !ok {
+							return d.Errf("module %s (%T) is not a WriterOpener", modID, unm)
+						}
+					}
+					l.Fallback.WriterRaw = caddyconfig.JSONModuleObject(wo, "output", moduleName, nil)
+				case "threshold":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					err := l.Fallback.Threshold.FromString(v)
+					if err != nil {
+						return fmt.Errorf("parse threshold parameter failed, invalid duration: %v", err)
+					}
+				case "probe_interval":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					err := l.Fallback.ProbeInterval.FromString(v)
+					if err != nil {
+						return fmt.Errorf("parse probe_interval parameter failed, invalid duration: %v", err)
+					}
+				case "replay":
+					l.Fallback.Replay = true
+				}
+			}
+		case "dead_letter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.DeadLetter = &DeadLetter{Filename: d.Val()}
+			for deadLetterBlock := d.Nesting(); d.NextBlock(deadLetterBlock); {
+				switch d.Val() {
+				case "roll_size_mb":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					i, err := strconv.Atoi(v)
+					if err != nil {
+						return fmt.Errorf("parse roll_size_mb parameter failed, invalid int: %v", err)
+					}
+					l.DeadLetter.RollSizeMB = i
+				case "roll_keep":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					i, err := strconv.Atoi(v)
+					if err != nil {
+						return fmt.Errorf("parse roll_keep parameter failed, invalid int: %v", err)
+					}
+					l.DeadLetter.RollKeep = i
+				case "roll_gzip":
+					l.DeadLetter.RollGzip = true
+				}
+			}
+		case "multiline":
+			l.Multiline = &Multiline{}
+			for multilineBlock := d.Nesting(); d.NextBlock(multilineBlock); {
+				switch d.Val() {
+				case "start_pattern":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					l.Multiline.StartPattern = d.Val()
+				case "max_wait":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					err := l.Multiline.MaxWait.FromString(v)
+					if err != nil {
+						return fmt.Errorf("parse max_wait parameter failed, invalid duration: %v", err)
+					}
+				case "max_lines":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					v := d.Val()
+					i, err := strconv.Atoi(v)
+					if err != nil {
+						return fmt.Errorf("parse max_lines parameter failed, invalid int: %v", err)
+					}
+					l.Multiline.MaxLines = i
+				}
+			}
+		case "line_format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			l.LineFormat = d.Val()
+		case "include_fields":
+			paths := d.RemainingArgs()
+			if len(paths) == 0 {
+				return d.ArgErr()
+			}
+			l.IncludeFields = append(l.IncludeFields, paths...)
+		case "exclude_fields":
+			paths := d.RemainingArgs()
+			if len(paths) == 0 {
+				return d.ArgErr()
+			}
+			l.ExcludeFields = append(l.ExcludeFields, paths...)
+		case "flatten":
+			l.Flatten = true
+			if d.NextArg() {
+				l.FlattenSeparator = d.Val()
+			}
 		case "timeout":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -447,33 +1152,83 @@ func (l *LokiLog) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 // Validate ensures the module is properly configured.
 func (l *LokiLog) Validate() error {
-	name := "caddy-logger-loki"
+	if len(l.Labels) == 0 {
+		return fmt.Errorf("labels is nil, at least one label is required")
+	}
+	if err := l.validateLabels(); err != nil {
+		return err
+	}
 
-	if l.Url == "" {
-		return fmt.Errorf("url is required")
+	if err := l.validateEncoding(); err != nil {
+		return err
 	}
-	u, err := url.Parse(l.Url)
+
+	backend, err := l.validateBackend()
 	if err != nil {
-		return fmt.Errorf("url is invalid: %v", err)
+		return err
 	}
-	u2 := flagext.URLValue{URL: u}
-
-	if len(l.Labels) == 0 {
-		return fmt.Errorf("labels is nil, at least one label is required")
+	u, err := l.validateURL(backend)
+	if err != nil {
+		return err
+	}
+	headers, tenantID := l.Headers, l.TenantId
+	if backend.tenantHeaders != nil && tenantID != "" {
+		tenantHeaders, err := backend.tenantHeaders(tenantID)
+		if err != nil {
+			return err
+		}
+		headers = make(map[string]string, len(l.Headers)+len(tenantHeaders))
+		for k, v := range l.Headers {
+			headers[k] = v
+		}
+		for k, v := range tenantHeaders {
+			headers[k] = v
+		}
+		tenantID = ""
 	}
 
 	if l.BatchWait.T == 0 {
 		l.BatchWait.T = 1 * time.Second
 	}
 
-	if l.BatchSize == 0 {
-		l.BatchSize = 1048576
+	if l.BatchSize.B == 0 {
+		l.BatchSize.B = 1048576
 	}
 
 	if l.TimeOut.T == 0 {
 		l.TimeOut.T = 10 * time.Second
 	}
 
+	switch l.MaxLineSizeTruncateMode {
+	case "":
+		if l.MaxLineSizeTruncate {
+			l.MaxLineSizeTruncateMode = truncateModeBytes
+		}
+	case truncateModeBytes, truncateModeJSON:
+		// the mode would silently do nothing, lines exceeding max_line_size are dropped
+		if !l.MaxLineSizeTruncate {
+			return fmt.Errorf("max_line_size_truncate_mode %s requires max_line_size_truncate", l.MaxLineSizeTruncateMode)
+		}
+	default:
+		return fmt.Errorf("max_line_size_truncate_mode %q is invalid, valid modes are: %s, %s", l.MaxLineSizeTruncateMode, truncateModeBytes, truncateModeJSON)
+	}
+
+	if l.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", l.Workers)
+	}
+	if l.Workers == 0 {
+		l.Workers = 1
+	}
+	if l.MaxInflightBatches < 0 {
+		return fmt.Errorf("max_inflight_batches must not be negative, got %d", l.MaxInflightBatches)
+	}
+	if l.MaxInflightBatches == 0 {
+		l.MaxInflightBatches = l.Workers
+	}
+	if l.MaxInflightBatches > l.Workers {
+		return fmt.Errorf("max_inflight_batches %d is higher than workers %d, every worker sends one batch at a time", l.MaxInflightBatches, l.Workers)
+	}
+
 	var proxyURL *url.URL
 	if l.ProxyURL != "" {
 		proxyURL, err = url.Parse(l.ProxyURL)
@@ -481,6 +1236,15 @@ func (l *LokiLog) Validate() error {
 			return fmt.Errorf("proxy_url is invalid: %v", err)
 		}
 	}
+	proxyConfig := config.ProxyConfig{
+		ProxyURL:             config.URL{URL: proxyURL},
+		NoProxy:              l.NoProxy,
+		ProxyFromEnvironment: l.ProxyFromEnvironment,
+		ProxyConnectHeader:   l.ProxyConnectHeader.ToPrometheusProxyHeader(),
+	}
+	if err := proxyConfig.Validate(); err != nil {
+		return fmt.Errorf("proxy config is invalid: %v", err)
+	}
 
 	if l.BackoffConfig.MaxRetries == 0 {
 		l.BackoffConfig.MaxRetries = 10
@@ -491,45 +1255,390 @@ func (l *LokiLog) Validate() error {
 	if l.BackoffConfig.MaxPeriod.T == 0 {
 		l.BackoffConfig.MaxPeriod.T = 5 * time.Minute
 	}
-	backoffConfig := backoff.Config{
+	if l.BackoffConfig.Jitter < 0 || l.BackoffConfig.Jitter > 1 {
+		return fmt.Errorf("backoff_config jitter must be between 0 and 1, got %v", l.BackoffConfig.Jitter)
+	}
+	backoffConfig := backoffConfig{
 		MinBackoff: l.BackoffConfig.MinPeriod.TimeDuration(),
 		MaxBackoff: l.BackoffConfig.MaxPeriod.TimeDuration(),
 		MaxRetries: l.BackoffConfig.MaxRetries,
+		Jitter:     l.BackoffConfig.Jitter,
+		MaxElapsed: l.BackoffConfig.MaxElapsed.TimeDuration(),
+	}
+
+	if l.LabelGuard != nil {
+		if l.LabelGuard.MaxValues < 0 {
+			return fmt.Errorf("label_guard max_values must not be negative, got %d", l.LabelGuard.MaxValues)
+		}
+		// without Provision, the values are counted for this loki log only
+		if l.labelValues == nil {
+			l.labelValues = newLabelValues()
+		}
+	}
+	if err := l.validateFallback(); err != nil {
+		return err
+	}
+	if l.Multiline != nil {
+		if l.Multiline.StartPattern == "" {
+			return fmt.Errorf("multiline requires a start_pattern")
+		}
+		l.Multiline.startPattern, err = regexp.Compile(l.Multiline.StartPattern)
+		if err != nil {
+			return fmt.Errorf("multiline start_pattern is invalid: %v", err)
+		}
+		if l.Multiline.MaxWait.T <= 0 {
+			l.Multiline.MaxWait.T = defaultMultilineMaxWait
+		}
+		if l.Multiline.MaxLines <= 0 {
+			l.Multiline.MaxLines = defaultMultilineMaxLines
+		}
+	}
+	separator := ""
+	if l.Flatten {
+		if l.FlattenSeparator == "" {
+			l.FlattenSeparator = defaultFlattenSeparator
+		}
+		separator = l.FlattenSeparator
+	}
+	l.lineFormatter, err = newLineFormatter(l.LineFormat, l.IncludeFields, l.ExcludeFields, separator)
+	if err != nil {
+		return err
+	}
+	if l.DeadLetter != nil {
+		if l.DeadLetter.Filename == "" {
+			return fmt.Errorf("dead_letter requires a filename")
+		}
+		if l.DeadLetter.RollSizeMB < 0 || l.DeadLetter.RollKeep < 0 {
+			return fmt.Errorf("dead_letter roll_size_mb and roll_keep must not be negative")
+		}
+		if l.DeadLetter.RollSizeMB == 0 {
+			l.DeadLetter.RollSizeMB = defaultDeadLetterRollSizeMB
+		}
+		if l.DeadLetter.RollKeep == 0 {
+			l.DeadLetter.RollKeep = defaultDeadLetterRollKeep
+		}
 	}
 
+	if err := l.validateAuth(); err != nil {
+		return err
+	}
 	var basicAuth *config.BasicAuth
 	if l.BasicAuth != nil {
 		basicAuth = l.BasicAuth.ToPrometheusBasicAuth()
 	}
+	var authorization *config.Authorization
+	if l.Authorization != nil {
+		authorization = l.Authorization.ToPrometheusAuthorization()
+	}
 	var oauth2 *config.OAuth2
 	if l.Oauth2 != nil {
 		oauth2 = l.Oauth2.ToPrometheusOAuth2()
 	}
-	l.clientConfig = client.Config{
-		Name:      name,
-		URL:       u2,
+	l.clientConfig = clientConfig{
+		URL:       u,
 		BatchWait: l.BatchWait.TimeDuration(),
-		BatchSize: l.BatchSize,
+		BatchSize: l.BatchSize.Bytes(),
 		Client: config.HTTPClientConfig{
 			BasicAuth:       basicAuth,
+			Authorization:   authorization,
 			OAuth2:          oauth2,
 			BearerToken:     config.Secret(l.BearerToken),
 			BearerTokenFile: l.BearTokenFile,
 			TLSConfig:       l.TlsConfig.ToPrometheusTLSConfig(),
-			ProxyConfig: config.ProxyConfig{
-				ProxyURL: config.URL{URL: proxyURL},
-			},
+			ProxyConfig:     proxyConfig,
 		},
-		Headers:                l.Headers,
-		BackoffConfig:          backoffConfig,
-		Timeout:                l.TimeOut.TimeDuration(),
-		TenantID:               l.TenantId,
-		DropRateLimitedBatches: l.DropRateLimitedBatches,
+		Headers:                 headers,
+		BackoffConfig:           backoffConfig,
+		Timeout:                 l.TimeOut.TimeDuration(),
+		TenantID:                tenantID,
+		DropRateLimitedBatches:  l.DropRateLimitedBatches,
+		RestampTooFarBehind:     l.RestampTooFarBehind,
+		MaxStreams:              l.MaxStreams,
+		MaxLineSize:             l.MaxLineSize.Bytes(),
+		MaxLineSizeTruncate:     l.MaxLineSizeTruncate,
+		MaxLineSizeTruncateJSON: l.MaxLineSizeTruncateMode == truncateModeJSON,
+		Workers:                 l.Workers,
+		MaxInflightBatches:      l.MaxInflightBatches,
+		Encoder:                 l.encoder,
+	}
+	if err := l.clientConfig.Client.Validate(); err != nil {
+		return fmt.Errorf("http client config is invalid: %v", err)
+	}
+	// load certificates and keys now, so a broken tls_config fails the config load instead of the first push
+	if _, err := l.TlsConfig.newTLSConfig(); err != nil {
+		return fmt.Errorf("tls_config is invalid: %v", err)
+	}
+
+	if l.VerifyOnStart {
+		if err := l.verifyReady(backend); err != nil {
+			return fmt.Errorf("verify_on_start failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// validateFallback checks the fallback writer and sets the defaults of the circuit breaker.
+func (l *LokiLog) validateFallback() error {
+	if l.Fallback == nil {
+		return nil
+	}
+	if l.Fallback.writerOpener == nil {
+		return fmt.Errorf("fallback requires an output writer")
+	}
+	if l.Fallback.Threshold.T < 0 || l.Fallback.ProbeInterval.T < 0 {
+		return fmt.Errorf("fallback threshold and probe_interval must not be negative")
+	}
+	if l.Fallback.Threshold.T == 0 {
+		l.Fallback.Threshold.T = defaultFallbackThreshold
+	}
+	if l.Fallback.ProbeInterval.T == 0 {
+		l.Fallback.ProbeInterval.T = defaultFallbackProbeInterval
+	}
+	if l.Fallback.Replay && l.Fallback.filename == "" {
+		return fmt.Errorf("fallback replay requires the file output")
+	}
+	return nil
+}
+
+/*
+validateURL checks the push url and returns the url requests are sent to, with the push path of the backend
+appended to a bare base url. For unix urls, it also sets up the transport to dial the socket.
+*/
+func (l *LokiLog) validateURL(backend backendProfile) (*url.URL, error) {
+	if l.Url == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(l.Url)
+	if err != nil {
+		return nil, fmt.Errorf("url is invalid: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" || u.Hostname() == "" {
+			return nil, fmt.Errorf("url %q is invalid, it has no host", l.Url)
+		}
+	case "unix":
+	default:
+		return nil, fmt.Errorf("url %q has unsupported scheme %q, valid schemes are: http, https, unix", l.Url, u.Scheme)
+	}
+	if u.RawQuery != "" && !backend.acceptsQuery {
+		return nil, fmt.Errorf("url %q is invalid, the query string would be ignored by %s", l.Url, l.Backend)
+	}
+	if u.Fragment != "" {
+		return nil, fmt.Errorf("url %q is invalid, it must not have a fragment", l.Url)
+	}
+
+	if err := l.validateTransport(u); err != nil {
+		return nil, err
+	}
+	if u.Scheme == "unix" {
+		l.transport.dialNetwork = "unix"
+		l.transport.dialAddress, u, err = parseUnixURL(u)
+		if err != nil {
+			return nil, fmt.Errorf("url is invalid: %v", err)
+		}
+	}
+
+	return backend.completePushPath(u, l.Protocol), nil
+}
+
+// verifyReady probes the readiness endpoint of the backend with the configured transport.
+func (l *LokiLog) verifyReady(backend backendProfile) error {
+	if backend.readyPath == "" {
+		return fmt.Errorf("backend %s has no readiness endpoint", l.Backend)
+	}
+	rt, err := l.newRoundTripper()
+	if err != nil {
+		return err
+	}
+
+	readyURL := backend.readyURL(l.clientConfig.URL, l.Protocol)
+	ctx, cancel := context.WithTimeout(context.Background(), l.TimeOut.TimeDuration())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, readyURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range l.clientConfig.Headers {
+		req.Header.Set(k, v)
+	}
+	if l.clientConfig.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.clientConfig.TenantID)
 	}
 
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned HTTP status %s", readyURL.Redacted(), resp.Status)
+	}
 	return nil
 }
 
+// validateEncoding checks the protocol and encoding and selects the encoder of the request body.
+func (l *LokiLog) validateEncoding() error {
+	if l.Protocol == "" {
+		l.Protocol = protocolLoki
+	}
+	if l.Encoding == "" {
+		l.Encoding = encodingProtobuf
+	}
+
+	switch l.Protocol {
+	case protocolLoki:
+		e, ok := encoders[l.Encoding]
+		if !ok {
+			return fmt.Errorf("encoding %q is invalid, valid encodings are: %s, %s, %s", l.Encoding, encodingProtobuf, encodingJSON, encodingJSONGzip)
+		}
+		l.encoder = e
+	case protocolOTLP:
+		if l.Encoding != encodingProtobuf {
+			return fmt.Errorf("encoding %q cannot be used with protocol otlp, only %s is supported", l.Encoding, encodingProtobuf)
+		}
+		l.encoder = otlpEncoder
+	default:
+		return fmt.Errorf("protocol %q is invalid, valid protocols are: %s, %s", l.Protocol, protocolLoki, protocolOTLP)
+	}
+	return nil
+}
+
+// validateBackend returns the profile of the configured backend and logs the settings it ignores.
+func (l *LokiLog) validateBackend() (backendProfile, error) {
+	if l.Backend == "" {
+		l.Backend = backendLoki
+	}
+	backend, ok := backends[l.Backend]
+	if !ok {
+		return backendProfile{}, fmt.Errorf("backend %q is invalid, valid backends are: %s, %s, %s", l.Backend, backendLoki, backendGrafanaCloud, backendVictoriaLogs)
+	}
+	if backend.warnings != nil {
+		for _, warning := range backend.warnings(l) {
+			l.logger.logger.Warn(warning, zap.String("backend", l.Backend))
+		}
+	}
+	return backend, nil
+}
+
+// validateTransport checks the connection level settings and fills in their defaults.
+func (l *LokiLog) validateTransport(u *url.URL) error {
+	if l.Dial != "" {
+		if u.Scheme == "unix" {
+			return fmt.Errorf("dial cannot be used together with a unix url")
+		}
+		network, address, err := parseDial(l.Dial)
+		if err != nil {
+			return fmt.Errorf("dial is invalid: %v", err)
+		}
+		l.transport.dialNetwork, l.transport.dialAddress = network, address
+	}
+
+	if l.IdleConnTimeout.T == 0 {
+		l.IdleConnTimeout.T = 5 * time.Minute
+	}
+	if l.MaxIdleConns == 0 {
+		l.MaxIdleConns = 20000
+	}
+	if l.MaxIdleConnsPerHost == 0 {
+		l.MaxIdleConnsPerHost = 1000
+	}
+	if l.MaxIdleConns < 0 || l.MaxIdleConnsPerHost < 0 || l.MaxConnsPerHost < 0 {
+		return fmt.Errorf("max_idle_conns, max_idle_conns_per_host and max_conns_per_host must not be negative")
+	}
+
+	l.transport.tlsConfig = l.TlsConfig
+	l.transport.disableKeepAlives = l.DisableKeepAlives
+	l.transport.idleConnTimeout = l.IdleConnTimeout.TimeDuration()
+	l.transport.maxIdleConns = l.MaxIdleConns
+	l.transport.maxIdleConnsPerHost = l.MaxIdleConnsPerHost
+	l.transport.maxConnsPerHost = l.MaxConnsPerHost
+	return nil
+}
+
+// validateAuth rejects conflicting authentication settings, the http client would otherwise pick one of them silently.
+func (l *LokiLog) validateAuth() error {
+	var configured []string
+	if l.BasicAuth != nil {
+		configured = append(configured, "basic_auth")
+	}
+	if l.Authorization != nil {
+		configured = append(configured, "authorization")
+	}
+	if l.Oauth2 != nil {
+		configured = append(configured, "oauth2")
+	}
+	if l.BearerToken != "" || l.BearTokenFile != "" {
+		configured = append(configured, "bearer_token")
+	}
+	if l.SigV4 != nil {
+		configured = append(configured, "sigv4")
+	}
+	if len(configured) > 1 {
+		return fmt.Errorf("at most one of basic_auth, authorization, oauth2, bearer_token/bearer_token_file and sigv4 can be configured, got: %s", strings.Join(configured, ", "))
+	}
+
+	if l.BearerToken != "" && l.BearTokenFile != "" {
+		return fmt.Errorf("bearer_token and bearer_token_file are mutually exclusive")
+	}
+	if l.BasicAuth != nil {
+		if l.BasicAuth.Username != "" && l.BasicAuth.UsernameFile != "" {
+			return fmt.Errorf("basic_auth username and username_file are mutually exclusive")
+		}
+		if l.BasicAuth.Password != "" && l.BasicAuth.PasswordFile != "" {
+			return fmt.Errorf("basic_auth password and password_file are mutually exclusive")
+		}
+	}
+	if l.Authorization != nil {
+		if l.Authorization.Credentials != "" && l.Authorization.CredentialsFile != "" {
+			return fmt.Errorf("authorization credentials and credentials_file are mutually exclusive")
+		}
+		if strings.ToLower(strings.TrimSpace(l.Authorization.Type)) == "basic" {
+			return fmt.Errorf(`authorization type cannot be set to "basic", use basic_auth instead`)
+		}
+		if l.Authorization.Type == "" {
+			l.Authorization.Type = "Bearer"
+		}
+	}
+	if l.Oauth2 != nil {
+		if l.Oauth2.ClientSecret != "" && l.Oauth2.ClientSecretFile != "" {
+			return fmt.Errorf("oauth2 client_secret and client_secret_file are mutually exclusive")
+		}
+	}
+	if l.SigV4 != nil {
+		if (l.SigV4.AccessKey == "") != (l.SigV4.SecretKey == "") {
+			return fmt.Errorf("sigv4 access_key and secret_key must be configured together")
+		}
+	}
+	return nil
+}
+
+// newRoundTripper builds the authenticated (and signed) transport for requests to the backend.
+func (l *LokiLog) newRoundTripper() (http.RoundTripper, error) {
+	rt, err := newRoundTripper(l.clientConfig.Client, l.transport)
+	if err != nil {
+		return nil, err
+	}
+	if l.SigV4 != nil {
+		return newSigV4RoundTripper(l.SigV4, rt)
+	}
+	return rt, nil
+}
+
+// parseTLSVersion parses a TLS version written as TLS13 or 1.3.
+func parseTLSVersion(s string) (config.TLSVersion, error) {
+	v := strings.ToUpper(strings.ReplaceAll(s, ".", ""))
+	if !strings.HasPrefix(v, "TLS") {
+		v = "TLS" + v
+	}
+	if version, ok := config.TLSVersions[v]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, valid versions are: 1.0, 1.1, 1.2, 1.3", s)
+}
+
 func (l *LokiLog) String() string {
 	return "loki"
 }
@@ -539,19 +1648,44 @@ func (l *LokiLog) WriterKey() string {
 }
 
 func (l *LokiLog) OpenWriter() (io.WriteCloser, error) {
-	// TODO: add metrics support.
-	metric := client.NewMetrics(nil)
-	c, err := client.New(metric, l.clientConfig, l.MaxStreams, l.MaxLineSize, l.MaxLineSizeTruncate, l.logger)
+	rt, err := l.newRoundTripper()
 	if err != nil {
 		return nil, err
 	}
+	cfg := l.clientConfig
+	m := getMetrics()
 
 	// do placeholder replacement
 	r := caddy.NewReplacer()
 	for k, v := range l.Labels {
 		l.Labels[k] = r.ReplaceAll(v, "")
+		// placeholders may have made the value too long
+		if l.SanitizeLabels {
+			l.Labels[k] = sanitizeLabelValue(l.Labels[k])
+		}
 	}
-	writer := newLokiWriter(c, l.logger, l.Labels)
+	labels := l.Labels
+	if l.LabelGuard != nil {
+		labels = guardLabels(l.LabelGuard, l.labelValues, l.Labels, m.rejectedLabels.MustCurryWith(prometheus.Labels{"host": cfg.URL.Host}))
+		if len(labels) == 0 {
+			return nil, fmt.Errorf("label_guard rejected all labels and no overflow value is set")
+		}
+	}
+
+	// opened once the labels are guarded, so no writer is left open on the errors above
+	if l.Fallback != nil {
+		fallback, err := l.Fallback.writerOpener.OpenWriter()
+		if err != nil {
+			return nil, fmt.Errorf("opening fallback writer failed: %v", err)
+		}
+		cfg.Breaker = newBreaker(l.Fallback, fallback, l.logger)
+	}
+	if l.DeadLetter != nil {
+		cfg.DeadLetter = newDeadLetter(l.DeadLetter)
+	}
+
+	c := newClient(cfg, rt, m, l.logger)
+	writer := newLokiWriter(c, l.logger, labels, l.Multiline, l.lineFormatter)
 
 	return writer, nil
 }
@@ -559,6 +1693,7 @@ func (l *LokiLog) OpenWriter() (io.WriteCloser, error) {
 // Interface guards
 var (
 	_ caddy.Provisioner     = (*LokiLog)(nil)
+	_ caddy.CleanerUpper    = (*LokiLog)(nil)
 	_ caddy.WriterOpener    = (*LokiLog)(nil)
 	_ caddyfile.Unmarshaler = (*LokiLog)(nil)
 )
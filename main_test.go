@@ -0,0 +1,248 @@
+package caddy_logger_loki
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/common/config"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		log      LokiLog
+		errorMsg string // empty means no error
+	}{
+		{"no auth", LokiLog{}, ""},
+		{"basic auth", LokiLog{BasicAuth: &BasicAuth{Password: "secret"}}, ""},
+		{"custom authorization scheme", LokiLog{Authorization: &Authorization{Credentials: "secret"}}, ""},
+		{"bearer token", LokiLog{BearerToken: "secret"}, ""},
+		{"basic auth and oauth2", LokiLog{BasicAuth: &BasicAuth{}, Oauth2: &OAuth2{}}, "got: basic_auth, oauth2"},
+		{"authorization and bearer token", LokiLog{Authorization: &Authorization{}, BearerToken: "secret"}, "got: authorization, bearer_token"},
+		{"authorization and bearer token file", LokiLog{Authorization: &Authorization{}, BearTokenFile: "/token"}, "got: authorization, bearer_token"},
+		{"bearer token and file", LokiLog{BearerToken: "secret", BearTokenFile: "/token"}, "bearer_token and bearer_token_file"},
+		{"basic authorization type", LokiLog{Authorization: &Authorization{Authorization: config.Authorization{Type: "basic"}}}, "use basic_auth instead"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.log.validateAuth()
+			if test.errorMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+				t.Fatalf("expected error containing %q, got %v", test.errorMsg, err)
+			}
+		})
+	}
+
+	log := LokiLog{Authorization: &Authorization{Credentials: "secret"}}
+	if err := log.validateAuth(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if log.Authorization.Type != "Bearer" {
+		t.Fatalf("expected default authorization type Bearer, got %q", log.Authorization.Type)
+	}
+}
+
+func TestUnmarshalCaddyfileProxy(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`loki {
+		url http://localhost:3100/loki/api/v1/push
+		proxy_url http://proxy.example.com:3128
+		no_proxy localhost,10.0.0.0/8
+		proxy_connect_header {
+			Proxy-Authorization "Basic c2VjcmV0"
+			X-Forwarded-For 10.0.0.1 10.0.0.2
+		}
+		labels {
+			job caddy
+		}
+	}`)
+
+	l := LokiLog{}
+	if err := l.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if l.ProxyURL != "http://proxy.example.com:3128" || l.NoProxy != "localhost,10.0.0.0/8" {
+		t.Fatalf("unexpected proxy settings: %q, %q", l.ProxyURL, l.NoProxy)
+	}
+	if len(l.ProxyConnectHeader["X-Forwarded-For"]) != 2 || l.ProxyConnectHeader["Proxy-Authorization"][0] != "Basic c2VjcmV0" {
+		t.Fatalf("unexpected proxy_connect_header: %v", l.ProxyConnectHeader)
+	}
+	if err := l.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := l.clientConfig.Client.ProxyConfig.GetProxyConnectHeader().Get("Proxy-Authorization"); got != "Basic c2VjcmV0" {
+		t.Fatalf("proxy connect header was not passed to the client config, got %q", got)
+	}
+
+	l.ProxyFromEnvironment = true
+	if err := l.Validate(); err == nil {
+		t.Fatalf("expected error for proxy_from_environment together with proxy_url")
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		backend  string
+		errorMsg string // empty means no error
+	}{
+		{"http://loki:3100", "", ""},
+		{"https://logs.example.com/loki/api/v1/push", "", ""},
+		{"unix:///run/loki.sock", "", ""},
+		{"loki:3100", "", `unsupported scheme "loki"`},
+		{"ftp://loki:3100", "", `unsupported scheme "ftp"`},
+		{"localhost:3100/loki/api/v1/push", "", "unsupported scheme"},
+		{"http:///loki/api/v1/push", "", "it has no host"},
+		{"http://:3100", "", "it has no host"},
+		{"http://loki:3100/loki/api/v1/push?tenant=a", "", "query string would be ignored by loki"},
+		{"http://victorialogs:9428/insert/loki/api/v1/push?_stream_fields=job", "victorialogs", ""},
+		{"http://loki:3100/loki/api/v1/push#logs", "", "must not have a fragment"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			l := LokiLog{Url: test.url, Backend: test.backend, Labels: map[string]string{"job": "caddy"}}
+			l.logger = newLogger(zap.NewNop())
+			err := l.Validate()
+			if test.errorMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+				t.Fatalf("expected error containing %q, got %v", test.errorMsg, err)
+			}
+		})
+	}
+}
+
+func TestValidateWorkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		workers  int
+		inflight int
+		errorMsg string // empty means no error
+	}{
+		{"defaults", 0, 0, ""},
+		{"inflight below workers", 4, 2, ""},
+		{"inflight equal to workers", 4, 4, ""},
+		{"negative workers", -1, 0, "workers must not be negative"},
+		{"negative inflight", 4, -1, "max_inflight_batches must not be negative"},
+		{"inflight above workers", 2, 4, "max_inflight_batches 4 is higher than workers 2"},
+		{"inflight above default workers", 0, 2, "max_inflight_batches 2 is higher than workers 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := LokiLog{Url: "http://loki:3100", Labels: map[string]string{"job": "caddy"}, Workers: test.workers, MaxInflightBatches: test.inflight}
+			l.logger = newLogger(zap.NewNop())
+			err := l.Validate()
+			if test.errorMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if l.MaxInflightBatches < 1 || l.MaxInflightBatches > l.Workers {
+					t.Fatalf("unexpected max_inflight_batches %d for workers %d", l.MaxInflightBatches, l.Workers)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+				t.Fatalf("expected error containing %q, got %v", test.errorMsg, err)
+			}
+		})
+	}
+}
+
+func TestValidateTruncateMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		truncate bool
+		mode     string
+		expected string
+		errorMsg string // empty means no error
+	}{
+		{"drop", false, "", "", ""},
+		{"truncate default mode", true, "", truncateModeBytes, ""},
+		{"truncate json", true, truncateModeJSON, truncateModeJSON, ""},
+		{"json without truncate", false, truncateModeJSON, "", "max_line_size_truncate_mode json requires max_line_size_truncate"},
+		{"bytes without truncate", false, truncateModeBytes, "", "requires max_line_size_truncate"},
+		{"invalid mode", true, "runes", "", `max_line_size_truncate_mode "runes" is invalid`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := LokiLog{Url: "http://loki:3100", Labels: map[string]string{"job": "caddy"}, MaxLineSizeTruncate: test.truncate, MaxLineSizeTruncateMode: test.mode}
+			l.logger = newLogger(zap.NewNop())
+			err := l.Validate()
+			if test.errorMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if l.MaxLineSizeTruncateMode != test.expected {
+					t.Fatalf("expected mode %q, got %q", test.expected, l.MaxLineSizeTruncateMode)
+				}
+				// validating again keeps the config valid
+				if err := l.Validate(); err != nil {
+					t.Fatalf("unexpected error validating again: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+				t.Fatalf("expected error containing %q, got %v", test.errorMsg, err)
+			}
+		})
+	}
+}
+
+func TestVerifyOnStart(t *testing.T) {
+	var ready atomic.Bool
+	var tenant atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/ready" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		tenant.Store(r.Header.Get("X-Scope-OrgID"))
+		if !ready.Load() {
+			http.Error(w, "Ingester not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ready"))
+	}))
+	defer server.Close()
+
+	l := LokiLog{
+		Url:           server.URL + "/prefix/loki/api/v1/push",
+		TenantId:      "tenant-a",
+		VerifyOnStart: true,
+		Labels:        map[string]string{"job": "caddy"},
+	}
+	l.logger = newLogger(zap.NewNop())
+	if err := l.Validate(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("expected error for a backend that isn't ready, got %v", err)
+	}
+
+	ready.Store(true)
+	if err := l.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tenant.Load() != "tenant-a" {
+		t.Fatalf("expected tenant header on readiness probe, got %q", tenant.Load())
+	}
+
+	l = LokiLog{Url: "https://logs.grafana.net", Backend: "grafana_cloud", VerifyOnStart: true, BasicAuth: &BasicAuth{Password: "token"}, Labels: map[string]string{"job": "caddy"}}
+	l.logger = newLogger(zap.NewNop())
+	if err := l.Validate(); err == nil || !strings.Contains(err.Error(), "no readiness endpoint") {
+		t.Fatalf("expected error for backend without readiness endpoint, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package caddy_logger_loki
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// Reasons entries are dropped or mutated for.
+const (
+	reasonGeneric       = "ingester_error"
+	reasonRateLimited   = "rate_limited"
+	reasonStreamLimited = "stream_limited"
+	reasonLineTooLong   = "line_too_long"
+)
+
+// Reasons label values are rejected for by the label guard.
+const (
+	reasonNotAllowed = "not_allowed"
+	reasonMaxValues  = "max_values"
+)
+
+/*
+metrics of all the writers, registered on the default registry which Caddy serves on its admin metrics endpoint.
+They are labelled by the host of the url, as the promtail client used to, so several writers can be told apart.
+*/
+type metrics struct {
+	encodedBytes    *prometheus.CounterVec
+	sentBytes       *prometheus.CounterVec
+	droppedBytes    *prometheus.CounterVec
+	sentEntries     *prometheus.CounterVec
+	droppedEntries  *prometheus.CounterVec
+	mutatedEntries  *prometheus.CounterVec
+	mutatedBytes    *prometheus.CounterVec
+	rejectedEntries *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	batchRetries    *prometheus.CounterVec
+	fallbackEntries *prometheus.CounterVec
+	fallbackActive  *prometheus.GaugeVec
+	rejectedLabels  *prometheus.CounterVec
+}
+
+var (
+	defaultMetrics     *metrics
+	defaultMetricsOnce sync.Once
+)
+
+// getMetrics returns the metrics registered on the default registry.
+func getMetrics() *metrics {
+	defaultMetricsOnce.Do(func() {
+		defaultMetrics = newMetrics(prometheus.DefaultRegisterer)
+	})
+	return defaultMetrics
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	const namespace, subsystem = "caddy", "loki_writer"
+	m := &metrics{
+		encodedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "encoded_bytes_total",
+			Help:      "Number of bytes encoded and ready to send.",
+		}, []string{"host"}),
+		sentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "sent_bytes_total",
+			Help:      "Number of bytes sent.",
+		}, []string{"host"}),
+		droppedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dropped_bytes_total",
+			Help:      "Number of bytes dropped because failed to be sent to the ingester after all retries.",
+		}, []string{"host", "tenant", "reason"}),
+		sentEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "sent_entries_total",
+			Help:      "Number of log entries sent to the ingester.",
+		}, []string{"host"}),
+		droppedEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dropped_entries_total",
+			Help:      "Number of log entries dropped because failed to be sent to the ingester after all retries.",
+		}, []string{"host", "tenant", "reason"}),
+		mutatedEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "mutated_entries_total",
+			Help:      "The total number of log entries that have been mutated.",
+		}, []string{"host", "tenant", "reason"}),
+		mutatedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "mutated_bytes_total",
+			Help:      "The total number of bytes that have been mutated.",
+		}, []string{"host", "tenant", "reason"}),
+		rejectedEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rejected_entries_total",
+			Help:      "Number of log entries rejected by the server, by the reason it gave.",
+		}, []string{"host", "tenant", "reason"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of send requests.",
+		}, []string{"status_code", "host"}),
+		batchRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "batch_retries_total",
+			Help:      "Number of times batches has had to be retried.",
+		}, []string{"host", "tenant"}),
+		fallbackEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "fallback_entries_total",
+			Help:      "Number of log entries written to the fallback writer.",
+		}, []string{"host"}),
+		fallbackActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "fallback_active",
+			Help:      "Whether logs are written to the fallback writer, because the server is unreachable.",
+		}, []string{"host"}),
+		rejectedLabels: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rejected_label_values_total",
+			Help:      "Number of label values rejected by the label guard, replaced by the overflow value or removed.",
+		}, []string{"host", "label", "reason"}),
+	}
+
+	m.encodedBytes = mustRegisterOrGet(reg, m.encodedBytes)
+	m.sentBytes = mustRegisterOrGet(reg, m.sentBytes)
+	m.droppedBytes = mustRegisterOrGet(reg, m.droppedBytes)
+	m.sentEntries = mustRegisterOrGet(reg, m.sentEntries)
+	m.droppedEntries = mustRegisterOrGet(reg, m.droppedEntries)
+	m.mutatedEntries = mustRegisterOrGet(reg, m.mutatedEntries)
+	m.mutatedBytes = mustRegisterOrGet(reg, m.mutatedBytes)
+	m.rejectedEntries = mustRegisterOrGet(reg, m.rejectedEntries)
+	m.requestDuration = mustRegisterOrGet(reg, m.requestDuration)
+	m.batchRetries = mustRegisterOrGet(reg, m.batchRetries)
+	m.fallbackEntries = mustRegisterOrGet(reg, m.fallbackEntries)
+	m.fallbackActive = mustRegisterOrGet(reg, m.fallbackActive)
+	m.rejectedLabels = mustRegisterOrGet(reg, m.rejectedLabels)
+	return m
+}
+
+// mustRegisterOrGet registers c, or returns the collector registered before with the same description.
+func mustRegisterOrGet[T prometheus.Collector](reg prometheus.Registerer, c T) T {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector.(T)
+		}
+		panic(err)
+	}
+	return c
+}
@@ -0,0 +1,106 @@
+package caddy_logger_loki
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Caddy writes one log line per Write, but the lines of console formatted logs, like stack traces, belong to a
+single entry. In multiline mode, lines are joined into one entry until a line matching the start pattern begins the
+next one, like the multiline stage of promtail.
+*/
+
+const (
+	defaultMultilineMaxWait  = 3 * time.Second
+	defaultMultilineMaxLines = 128
+)
+
+// Multiline configures joining lines into multiline entries.
+type Multiline struct {
+	// Regular expression matching the first line of an entry, e.g. `^\d{4}/\d{2}/\d{2}`.
+	StartPattern string `json:"start_pattern,omitempty"`
+
+	// Maximum time to wait for the next line of an entry, before sending it. default is 3s.
+	MaxWait StrTimeDuration `json:"max_wait,omitempty"`
+
+	// Maximum number of lines of an entry, further lines start a new entry. default is 128.
+	MaxLines int `json:"max_lines,omitempty"`
+
+	startPattern *regexp.Regexp
+}
+
+// multiline joins lines into entries, and hands each complete entry to handle.
+type multiline struct {
+	cfg    *Multiline
+	handle func(line string, ts time.Time)
+
+	mu sync.Mutex
+	// lines of the pending entry
+	lines []string
+	// time of the first line of the pending entry
+	ts time.Time
+	// counts the added lines, so a timer of an earlier line doesn't send the pending entry
+	seq   uint64
+	timer *time.Timer
+	// set on close, after which the pending entry is sent by close only
+	closed bool
+}
+
+func newMultiline(cfg *Multiline, handle func(line string, ts time.Time)) *multiline {
+	return &multiline{cfg: cfg, handle: handle}
+}
+
+// add appends line to the pending entry, or sends the pending entry first if line starts a new one.
+func (m *multiline) add(line string, ts time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		m.handle(line, ts)
+		return
+	}
+
+	if len(m.lines) > 0 && (m.cfg.startPattern.MatchString(line) || len(m.lines) >= m.cfg.MaxLines) {
+		m.flushLocked()
+	}
+	if len(m.lines) == 0 {
+		m.ts = ts
+	}
+	m.lines = append(m.lines, line)
+
+	// send the entry once no line followed for max_wait
+	m.seq++
+	seq := m.seq
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.timer = time.AfterFunc(m.cfg.MaxWait.TimeDuration(), func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.seq == seq && !m.closed {
+			m.flushLocked()
+		}
+	})
+}
+
+// flushLocked sends the pending entry, m.mu must be held.
+func (m *multiline) flushLocked() {
+	if len(m.lines) == 0 {
+		return
+	}
+	m.handle(strings.Join(m.lines, "\n"), m.ts)
+	m.lines = m.lines[:0]
+}
+
+// close sends the pending entry, later lines are sent as entries of their own.
+func (m *multiline) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.closed = true
+	m.flushLocked()
+}
@@ -0,0 +1,103 @@
+package caddy_logger_loki
+
+import (
+	"encoding/json"
+	"github.com/grafana/loki/pkg/push"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+	"strings"
+)
+
+// Protocols used to push logs.
+const (
+	// Loki's push API, /loki/api/v1/push
+	protocolLoki = "loki"
+	// OTLP/HTTP logs, e.g. Loki's native /otlp/v1/logs endpoint or any OpenTelemetry collector
+	protocolOTLP = "otlp"
+)
+
+// otlpScopeName is the instrumentation scope name of the exported log records.
+const otlpScopeName = "caddy-logger-loki"
+
+var otlpEncoder = encoder{
+	contentType: "application/x-protobuf",
+	encode:      encodeOTLP,
+}
+
+/*
+encodeOTLP converts req into an OTLP/HTTP protobuf export request. Stream labels become resource attributes
+and every entry becomes a LogRecord. For JSON lines, as emitted by Caddy's json encoder, the msg field becomes the
+body, the level field the severity and all other fields attributes. Other lines are sent as body unchanged.
+*/
+func encodeOTLP(req *push.PushRequest) ([]byte, error) {
+	logs := plog.NewLogs()
+	for _, stream := range req.Streams {
+		labels, err := parseLabels(stream.Labels)
+		if err != nil {
+			return nil, err
+		}
+
+		resourceLogs := logs.ResourceLogs().AppendEmpty()
+		for k, v := range labels {
+			resourceLogs.Resource().Attributes().PutStr(k, v)
+		}
+		scopeLogs := resourceLogs.ScopeLogs().AppendEmpty()
+		scopeLogs.Scope().SetName(otlpScopeName)
+
+		records := scopeLogs.LogRecords()
+		records.EnsureCapacity(len(stream.Entries))
+		for _, entry := range stream.Entries {
+			record := records.AppendEmpty()
+			ts := pcommon.NewTimestampFromTime(entry.Timestamp)
+			record.SetTimestamp(ts)
+			record.SetObservedTimestamp(ts)
+			fillOTLPRecord(record, entry.Line)
+			for _, l := range entry.StructuredMetadata {
+				record.Attributes().PutStr(l.Name, l.Value)
+			}
+		}
+	}
+	return plogotlp.NewExportRequestFromLogs(logs).MarshalProto()
+}
+
+// fillOTLPRecord sets body, severity and attributes of record from a log line.
+func fillOTLPRecord(record plog.LogRecord, line string) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		record.Body().SetStr(line)
+		return
+	}
+
+	if msg, ok := fields["msg"].(string); ok {
+		record.Body().SetStr(msg)
+		delete(fields, "msg")
+	} else {
+		record.Body().SetStr(line)
+	}
+	if level, ok := fields["level"].(string); ok {
+		record.SetSeverityText(level)
+		record.SetSeverityNumber(otlpSeverity(level))
+		delete(fields, "level")
+	}
+	// FromRaw only fails for unsupported value types, which encoding/json never produces
+	_ = record.Attributes().FromRaw(fields)
+}
+
+// otlpSeverity maps zap log levels to OTLP severity numbers.
+func otlpSeverity(level string) plog.SeverityNumber {
+	switch strings.ToLower(level) {
+	case "debug":
+		return plog.SeverityNumberDebug
+	case "info":
+		return plog.SeverityNumberInfo
+	case "warn", "warning":
+		return plog.SeverityNumberWarn
+	case "error":
+		return plog.SeverityNumberError
+	case "dpanic", "panic", "fatal":
+		return plog.SeverityNumberFatal
+	default:
+		return plog.SeverityNumberUnspecified
+	}
+}
@@ -0,0 +1,73 @@
+package caddy_logger_loki
+
+import (
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+	"testing"
+)
+
+func TestOTLPProtocol(t *testing.T) {
+	s := &testServer{}
+	l := LokiLog{
+		Url:      s.start(t) + "/otlp/v1/logs",
+		Protocol: "otlp",
+		Labels:   map[string]string{"service_name": "caddy"},
+	}
+	pushLines(t, &l,
+		`{"level":"error","ts":1722513600.5,"logger":"http.log.access","msg":"handled request","request":{"method":"GET"},"status":502}`,
+		`plain text line`,
+	)
+	push := s.first(t)
+
+	if push.header.Get("Content-Type") != "application/x-protobuf" {
+		t.Fatalf("unexpected content type %q", push.header.Get("Content-Type"))
+	}
+	req := plogotlp.NewExportRequest()
+	if err := req.UnmarshalProto(push.body); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resourceLogs := req.Logs().ResourceLogs().At(0)
+	if v, _ := resourceLogs.Resource().Attributes().Get("service_name"); v.Str() != "caddy" {
+		t.Fatalf("expected resource attribute service_name=caddy, got %v", resourceLogs.Resource().Attributes().AsRaw())
+	}
+	records := resourceLogs.ScopeLogs().At(0).LogRecords()
+	if records.Len() != 2 {
+		t.Fatalf("expected 2 log records, got %d", records.Len())
+	}
+
+	record := records.At(0)
+	if record.Body().Str() != "handled request" {
+		t.Fatalf("unexpected body %q", record.Body().Str())
+	}
+	if record.SeverityText() != "error" || record.SeverityNumber() != plog.SeverityNumberError {
+		t.Fatalf("unexpected severity %q %v", record.SeverityText(), record.SeverityNumber())
+	}
+	attributes := record.Attributes().AsRaw()
+	if attributes["logger"] != "http.log.access" || attributes["status"] != float64(502) {
+		t.Fatalf("unexpected attributes %v", attributes)
+	}
+	if request, ok := attributes["request"].(map[string]any); !ok || request["method"] != "GET" {
+		t.Fatalf("expected nested request attribute, got %v", attributes["request"])
+	}
+	if _, ok := attributes["msg"]; ok {
+		t.Fatalf("msg must not be duplicated as attribute")
+	}
+	if record.Timestamp() == 0 {
+		t.Fatalf("timestamp is not set")
+	}
+
+	record = records.At(1)
+	if record.Body().Str() != "plain text line" || record.Attributes().Len() != 0 {
+		t.Fatalf("unexpected record for plain text line: %q %v", record.Body().Str(), record.Attributes().AsRaw())
+	}
+
+	l = LokiLog{Url: s.start(t), Protocol: "otlp", Encoding: "json", Labels: map[string]string{"job": "caddy"}}
+	if err := l.Validate(); err == nil {
+		t.Fatalf("expected error for json encoding with otlp protocol")
+	}
+	l = LokiLog{Url: s.start(t), Protocol: "syslog", Labels: map[string]string{"job": "caddy"}}
+	if err := l.Validate(); err == nil {
+		t.Fatalf("expected error for unknown protocol")
+	}
+}
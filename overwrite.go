@@ -28,9 +28,26 @@ func (b BasicAuth) ToPrometheusBasicAuth() *config.BasicAuth {
 	return &b.BasicAuth
 }
 
+type Authorization struct {
+	config.Authorization `json:",inline"`
+	Credentials          Secret `json:"credentials,omitempty"`
+}
+
+// ToPrometheusAuthorization converts Authorization to config.Authorization.
+func (a Authorization) ToPrometheusAuthorization() *config.Authorization {
+	a.Authorization.Credentials = config.Secret(a.Credentials)
+	return &a.Authorization
+}
+
 type TLSConfig struct {
 	config.TLSConfig `json:",inline"`
 	Key              Secret `json:"key,omitempty"`
+
+	// Cipher suites allowed up to TLS 1.2 by their crypto/tls name, TLS 1.3 cipher suites are not configurable.
+	CipherSuites []string `json:"cipher_suites,omitempty"`
+
+	// Base64 encoded SHA-256 hashes of pinned SubjectPublicKeyInfos, at least one certificate of the server chain must match.
+	PinnedSHA256 []string `json:"pin_sha256,omitempty"`
 }
 
 // ToPrometheusTLSConfig converts TLSConfig to config.TLSConfig.
@@ -51,3 +68,21 @@ func (o OAuth2) ToPrometheusOAuth2() *config.OAuth2 {
 	o.OAuth2.TLSConfig = o.TlsConfig.ToPrometheusTLSConfig()
 	return &o.OAuth2
 }
+
+type ProxyHeader map[string][]Secret
+
+// ToPrometheusProxyHeader converts ProxyHeader to config.ProxyHeader.
+func (h ProxyHeader) ToPrometheusProxyHeader() config.ProxyHeader {
+	if h == nil {
+		return nil
+	}
+	header := make(config.ProxyHeader, len(h))
+	for name, values := range h {
+		secrets := make([]config.Secret, 0, len(values))
+		for _, value := range values {
+			secrets = append(secrets, config.Secret(value))
+		}
+		header[name] = secrets
+	}
+	return header
+}
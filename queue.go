@@ -0,0 +1,105 @@
+package caddy_logger_loki
+
+import (
+	"sync"
+)
+
+/*
+	Entries are handed from the writers to the workers through queues, instead of a channel per entry. A write
+appends its line to the byte buffer of the queue and its entry to the entry buffer, which allocates nothing once the
+buffers have grown. The worker takes all queued entries at once and swaps in the buffers it drained before, so the
+two pairs of buffers are reused for as long as the client runs. The lines taken at once are converted to a single
+string, which the lines of the entries are sliced from.
+*/
+
+// maxQueuedEntries is the number of entries a queue holds before writes wait for the worker.
+const maxQueuedEntries = 4096
+
+// queuedEntry is an entry waiting in a queue, its line is in the buffer of the queue, up to end.
+type queuedEntry struct {
+	entry
+	end int
+}
+
+// queue holds the entries handed to a worker.
+type queue struct {
+	mu      sync.Mutex
+	notFull *sync.Cond
+	entries []queuedEntry
+	buf     []byte
+	closed  bool
+	// set when the client stops retrying, writes to a full queue don't wait for the worker anymore
+	aborted bool
+
+	// signals the worker that entries are queued, or the queue is closed
+	notify chan struct{}
+}
+
+func newQueue() *queue {
+	q := &queue{notify: make(chan struct{}, 1)}
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+/*
+enqueue appends e with line to q, it waits while q is full. The line of e is ignored. It returns false if q is
+closed, or full and aborted.
+*/
+func enqueue[L string | []byte](q *queue, e entry, line L) bool {
+	q.mu.Lock()
+	full := func() bool { return len(q.entries) >= maxQueuedEntries }
+	for full() && !q.closed && !q.aborted {
+		q.notFull.Wait()
+	}
+	if q.closed || full() {
+		q.mu.Unlock()
+		return false
+	}
+	q.buf = append(q.buf, line...)
+	e.Line = ""
+	q.entries = append(q.entries, queuedEntry{entry: e, end: len(q.buf)})
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+/*
+take returns the queued entries with their lines, and keeps entries and buf, drained by the caller before, as
+buffers of q. It returns closed once q is closed and empty.
+*/
+func (q *queue) take(entries []queuedEntry, buf []byte) ([]queuedEntry, []byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) == 0 {
+		return entries[:0], buf[:0], q.closed
+	}
+	taken, takenBuf := q.entries, q.buf
+	q.entries, q.buf = entries[:0], buf[:0]
+	q.notFull.Broadcast()
+	return taken, takenBuf, false
+}
+
+// abort wakes the writes waiting for q, which then fail if q is still full.
+func (q *queue) abort() {
+	q.mu.Lock()
+	q.aborted = true
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+}
+
+// close closes q, the worker takes the queued entries before stopping.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
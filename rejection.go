@@ -0,0 +1,207 @@
+package caddy_logger_loki
+
+import (
+	"github.com/grafana/loki/pkg/push"
+	"go.uber.org/zap"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Loki validates every entry of a push request. It stores the valid entries and responds with 400 and a message
+per rejected entry, so a rejection must not drop the whole batch. The messages are matched against the entries of
+the request by stream, and by timestamp or line length.
+*/
+
+// Reasons Loki rejects entries for, named like Loki's discarded samples reasons.
+const (
+	reasonOutOfOrder   = "out_of_order"
+	reasonTooFarBehind = "too_far_behind"
+	reasonTooOld       = "greater_than_max_sample_age"
+	reasonTooNew       = "too_far_in_future"
+	// the request is too large, even with a single entry
+	reasonRequestTooLarge = "request_too_large"
+)
+
+// layout of timestamps in the messages of the ingester, as formatted by time.Time.String
+const ingesterTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+var (
+	// entry with timestamp 2024-08-01 12:00:00 +0000 UTC ignored, reason: 'entry out of order',
+	ingesterRejectionRegexp = regexp.MustCompile(`entry with timestamp (.+?) ignored, reason: '(.+?)',`)
+	// user 'fake', total ignored: 1 out of 2 for stream: {job="caddy"}
+	ingesterStreamRegexp = regexp.MustCompile(`total ignored: \d+ out of \d+ for stream: (\{.*\})`)
+	// entry for stream '{job="caddy"}' has timestamp too old: 2024-08-01T12:00:00Z, oldest acceptable timestamp is: ...
+	tooOldRegexp = regexp.MustCompile(`entry for stream '(\{.*?\})' has timestamp too old: (\S+?),`)
+	// entry for stream '{job="caddy"}' has timestamp too new: 2024-08-01T12:00:00Z
+	tooNewRegexp = regexp.MustCompile(`entry for stream '(\{.*?\})' has timestamp too new: (\S+)`)
+	// Max entry size '262144' bytes exceeded for stream '{job="caddy"}' while adding an entry with length '262145' bytes
+	lineTooLongRegexp = regexp.MustCompile(`Max entry size '\d+' bytes exceeded for stream '(\{.*?\})' while adding an entry with length '(\d+)' bytes`)
+)
+
+// rejection is an entry rejected by Loki.
+type rejection struct {
+	reason string
+	stream string
+	// timestamp of the entry, zero if unknown
+	timestamp time.Time
+	// timestamps in the message are truncated to this precision
+	precision time.Duration
+	// length of the line, 0 if unknown
+	length int
+}
+
+// parseRejections parses the rejected entries out of the body of a 400 response.
+func parseRejections(body string) []rejection {
+	var rejections []rejection
+	// the ingester lists the rejected entries of a stream before the stream
+	var pending []rejection
+	for _, line := range strings.Split(body, "\n") {
+		for _, m := range ingesterRejectionRegexp.FindAllStringSubmatch(line, -1) {
+			ts, err := time.Parse(ingesterTimeLayout, m[1])
+			if err != nil {
+				continue
+			}
+			reason := reasonGeneric
+			switch {
+			case strings.Contains(m[2], "out of order"):
+				reason = reasonOutOfOrder
+			case strings.Contains(m[2], "too far behind"):
+				reason = reasonTooFarBehind
+			}
+			pending = append(pending, rejection{reason: reason, timestamp: ts})
+		}
+		if m := ingesterStreamRegexp.FindStringSubmatch(line); m != nil {
+			for _, r := range pending {
+				r.stream = m[1]
+				rejections = append(rejections, r)
+			}
+			pending = nil
+		}
+
+		for _, m := range tooOldRegexp.FindAllStringSubmatch(line, -1) {
+			if ts, err := time.Parse(time.RFC3339, m[2]); err == nil {
+				rejections = append(rejections, rejection{reason: reasonTooOld, stream: m[1], timestamp: ts, precision: time.Second})
+			}
+		}
+		for _, m := range tooNewRegexp.FindAllStringSubmatch(line, -1) {
+			if ts, err := time.Parse(time.RFC3339, m[2]); err == nil {
+				rejections = append(rejections, rejection{reason: reasonTooNew, stream: m[1], timestamp: ts, precision: time.Second})
+			}
+		}
+		for _, m := range lineTooLongRegexp.FindAllStringSubmatch(line, -1) {
+			if length, err := strconv.Atoi(m[2]); err == nil {
+				rejections = append(rejections, rejection{reason: reasonLineTooLong, stream: m[1], length: length})
+			}
+		}
+	}
+	return rejections
+}
+
+// matches reports whether e of stream is the rejected entry.
+func (r rejection) matches(stream string, e push.Entry) bool {
+	if !sameStream(r.stream, stream) {
+		return false
+	}
+	if r.length > 0 {
+		return len(e.Line) == r.length
+	}
+	return e.Timestamp.Truncate(r.precision).Equal(r.timestamp)
+}
+
+// restampable reports whether the entry was rejected for being too old, so it is accepted with a new timestamp.
+func (r rejection) restampable() bool {
+	return r.reason == reasonOutOfOrder || r.reason == reasonTooFarBehind || r.reason == reasonTooOld
+}
+
+// sameStream compares two stream selectors, which may differ in formatting.
+func sameStream(a, b string) bool {
+	if a == b {
+		return true
+	}
+	la, err := parseLabels(a)
+	if err != nil {
+		return false
+	}
+	lb, err := parseLabels(b)
+	if err != nil || len(la) != len(lb) {
+		return false
+	}
+	for k, v := range la {
+		if lb[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the first entry of req matching r, which isn't marked as rejected yet.
+func (r rejection) find(req *push.PushRequest, rejected [][]bool) (stream, entry int, found bool) {
+	for i, s := range req.Streams {
+		for j, e := range s.Entries {
+			if !rejected[i][j] && r.matches(s.Labels, e) {
+				return i, j, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+/*
+handleRejections counts the entries of req rejected by Loki, the others are stored. With restamp, entries rejected
+for being too old are sent again with the current time, keeping their order.
+*/
+func (c *client) handleRejections(tenantID string, req *push.PushRequest, rejections []rejection, restamp bool) {
+	host := c.cfg.URL.Host
+	rejected := make([][]bool, len(req.Streams))
+	for i, stream := range req.Streams {
+		rejected[i] = make([]bool, len(stream.Entries))
+	}
+
+	restamped := &push.PushRequest{}
+	restampedStreams := map[string]int{}
+	now := time.Now()
+	for _, r := range rejections {
+		c.metrics.rejectedEntries.WithLabelValues(host, tenantID, r.reason).Inc()
+
+		i, j, found := r.find(req, rejected)
+		if !found {
+			c.metrics.droppedEntries.WithLabelValues(host, tenantID, r.reason).Inc()
+			continue
+		}
+		rejected[i][j] = true
+		e, labels := req.Streams[i].Entries[j], req.Streams[i].Labels
+
+		if !restamp || !r.restampable() {
+			c.metrics.droppedEntries.WithLabelValues(host, tenantID, r.reason).Inc()
+			c.metrics.droppedBytes.WithLabelValues(host, tenantID, r.reason).Add(float64(len(e.Line)))
+			c.writeDeadLetter(tenantID, r.reason, push.Stream{Labels: labels, Entries: []push.Entry{e}})
+			continue
+		}
+		s, ok := restampedStreams[labels]
+		if !ok {
+			s = len(restamped.Streams)
+			restampedStreams[labels] = s
+			restamped.Streams = append(restamped.Streams, push.Stream{Labels: labels})
+		}
+		// a nanosecond apart, so the entries keep their order
+		e.Timestamp = now.Add(time.Duration(countEntries(restamped)))
+		restamped.Streams[s].Entries = append(restamped.Streams[s].Entries, e)
+		c.metrics.mutatedEntries.WithLabelValues(host, tenantID, r.reason).Inc()
+	}
+
+	if accepted := countEntries(req) - len(rejections); accepted > 0 {
+		c.metrics.sentEntries.WithLabelValues(host).Add(float64(accepted))
+	}
+	c.logger.logger.Warn("entries rejected by the server",
+		zap.String("tenant", tenantID),
+		zap.Int("rejected", len(rejections)),
+		zap.Int("restamped", countEntries(restamped)),
+	)
+
+	if len(restamped.Streams) > 0 {
+		c.sendRequest(tenantID, restamped, false)
+	}
+}
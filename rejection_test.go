@@ -0,0 +1,161 @@
+package caddy_logger_loki
+
+import (
+	"fmt"
+	logproto "github.com/grafana/loki/pkg/push"
+	"github.com/prometheus/common/model"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRejections(t *testing.T) {
+	ts := time.Date(2024, 8, 1, 12, 0, 0, 500000000, time.UTC)
+	tests := []struct {
+		name     string
+		body     string
+		expected []rejection
+	}{
+		{
+			name: "ingester",
+			body: "entry with timestamp 2024-08-01 12:00:00.5 +0000 UTC ignored, reason: 'entry out of order',\n" +
+				"entry with timestamp 2024-08-01 12:00:00.5 +0000 UTC ignored, reason: 'entry too far behind, entry timestamp is: 2024-08-01T12:00:00Z, oldest acceptable timestamp is: 2024-08-01T13:00:00Z',\n" +
+				`user 'fake', total ignored: 2 out of 3 for stream: {job="caddy"}`,
+			expected: []rejection{
+				{reason: reasonOutOfOrder, stream: `{job="caddy"}`, timestamp: ts},
+				{reason: reasonTooFarBehind, stream: `{job="caddy"}`, timestamp: ts},
+			},
+		},
+		{
+			name: "distributor",
+			body: `entry for stream '{job="caddy"}' has timestamp too old: 2024-08-01T12:00:00Z, oldest acceptable timestamp is: 2024-08-08T12:00:00Z` + "\n" +
+				`entry for stream '{job="caddy"}' has timestamp too new: 2024-08-01T12:00:00Z` + "\n" +
+				`Max entry size '4' bytes exceeded for stream '{job="caddy"}' while adding an entry with length '6' bytes`,
+			expected: []rejection{
+				{reason: reasonTooOld, stream: `{job="caddy"}`, timestamp: ts.Truncate(time.Second), precision: time.Second},
+				{reason: reasonTooNew, stream: `{job="caddy"}`, timestamp: ts.Truncate(time.Second), precision: time.Second},
+				{reason: reasonLineTooLong, stream: `{job="caddy"}`, length: 6},
+			},
+		},
+		{
+			name: "unknown",
+			body: "error at least one label pair is required per stream",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rejections := parseRejections(test.body)
+			if len(rejections) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, rejections)
+			}
+			for i, r := range rejections {
+				e := test.expected[i]
+				if r.reason != e.reason || r.stream != e.stream || !r.timestamp.Equal(e.timestamp) || r.precision != e.precision || r.length != e.length {
+					t.Fatalf("expected %v, got %v", e, r)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitPushRequest(t *testing.T) {
+	req := &logproto.PushRequest{Streams: []logproto.Stream{
+		{Labels: `{job="a"}`, Entries: []logproto.Entry{{Line: "1"}, {Line: "2"}}},
+		{Labels: `{job="b"}`, Entries: []logproto.Entry{{Line: "3"}, {Line: "4"}, {Line: "5"}}},
+	}}
+	first, second := splitPushRequest(req)
+	if countEntries(first) != 2 || countEntries(second) != 3 {
+		t.Fatalf("expected 2 and 3 entries, got %d and %d", countEntries(first), countEntries(second))
+	}
+
+	req.Streams = req.Streams[1:]
+	first, second = splitPushRequest(req)
+	if len(first.Streams) != 1 || len(second.Streams) != 1 || first.Streams[0].Entries[0].Line != "3" || second.Streams[0].Entries[0].Line != "4" {
+		t.Fatalf("expected the stream to be split, got %v and %v", first, second)
+	}
+}
+
+// lokiResponses responds like Loki: with 413 to requests of more than maxEntries entries and with 400 to entries older than oldest.
+func lokiResponses(maxEntries int, oldest time.Time) func(push receivedPush) (int, string) {
+	return func(push receivedPush) (int, string) {
+		req := push.req
+		if countEntries(req) > maxEntries {
+			return http.StatusRequestEntityTooLarge, "request body too large"
+		}
+		var msg string
+		for _, stream := range req.Streams {
+			ignored := 0
+			for _, e := range stream.Entries {
+				if e.Timestamp.Before(oldest) {
+					msg += "entry with timestamp " + e.Timestamp.String() + " ignored, reason: 'entry too far behind',\n"
+					ignored++
+				}
+			}
+			if ignored > 0 {
+				msg += fmt.Sprintf("user 'fake', total ignored: %d out of %d for stream: %s\n", ignored, len(stream.Entries), stream.Labels)
+			}
+		}
+		if msg != "" {
+			return http.StatusBadRequest, msg
+		}
+		return http.StatusNoContent, ""
+	}
+}
+
+func TestClientRejections(t *testing.T) {
+	tests := []struct {
+		name    string
+		restamp bool
+		// lines stored by the server
+		stored []string
+	}{
+		{"drop", false, []string{"1", "2", "4"}},
+		{"restamp", true, []string{"1", "2", "4", "3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &testServer{respond: lokiResponses(2, time.Now().Add(-time.Hour))}
+			c, m := newTestClient(t, s, clientConfig{RestampTooFarBehind: test.restamp})
+			for i, line := range []string{"1", "2", "3", "4"} {
+				ts := time.Now()
+				if i == 2 {
+					ts = ts.Add(-2 * time.Hour)
+				}
+				c.handle(entry{labels: model.LabelSet{"job": "caddy"}, Entry: logproto.Entry{Timestamp: ts, Line: line}})
+			}
+			c.Stop()
+
+			// requests too large are split in halves, accepted entries of rejected requests are stored
+			var stored []string
+			for _, req := range s.requests() {
+				if countEntries(req) > 2 {
+					continue
+				}
+				for _, stream := range req.Streams {
+					for _, e := range stream.Entries {
+						if !e.Timestamp.Before(time.Now().Add(-time.Hour)) {
+							stored = append(stored, e.Line)
+						}
+					}
+				}
+			}
+			if fmt.Sprint(stored) != fmt.Sprint(test.stored) {
+				t.Fatalf("expected stored lines %v, got %v", test.stored, stored)
+			}
+
+			host := c.cfg.URL.Host
+			if rejected := counterValue(t, m.rejectedEntries.WithLabelValues(host, "", reasonTooFarBehind)); rejected != 1 {
+				t.Fatalf("expected 1 rejected entry, got %v", rejected)
+			}
+			dropped := counterValue(t, m.droppedEntries.WithLabelValues(host, "", reasonTooFarBehind))
+			if test.restamp && dropped != 0 || !test.restamp && dropped != 1 {
+				t.Fatalf("unexpected dropped entries: %v", dropped)
+			}
+			if sent := counterValue(t, m.sentEntries.WithLabelValues(host)); sent != float64(len(test.stored)) {
+				t.Fatalf("expected %d sent entries, got %v", len(test.stored), sent)
+			}
+		})
+	}
+}
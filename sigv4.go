@@ -0,0 +1,170 @@
+// The sigv4 round tripper is adapted from github.com/prometheus/sigv4:
+//
+// Copyright 2021 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caddy_logger_loki
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	signer "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SigV4 configures AWS Signature Version 4 signing of every push request, like prometheus remote-write does.
+type SigV4 struct {
+	// The AWS region. If blank, the region from the default credentials chain is used.
+	Region string `json:"region,omitempty"`
+
+	// The AWS API keys. If blank, the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are used.
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey Secret `json:"secret_key,omitempty"`
+
+	// Named AWS profile used to authenticate.
+	Profile string `json:"profile,omitempty"`
+
+	// AWS Role ARN, an alternative to using AWS API keys.
+	RoleARN string `json:"role_arn,omitempty"`
+
+	// The AWS service name requests are signed for, default is execute-api (AWS API Gateway).
+	Service string `json:"service,omitempty"`
+}
+
+// sigv4HeaderDenylist holds headers that may be altered on the way to the server, so they must not be signed.
+var sigv4HeaderDenylist = []string{
+	"uber-trace-id",
+}
+
+// sigv4SignedHeaders are the headers set by the signer, which are copied to the request sent.
+var sigv4SignedHeaders = []string{
+	"Authorization",
+	"X-Amz-Date",
+	"X-Amz-Security-Token",
+}
+
+type sigV4RoundTripper struct {
+	region  string
+	service string
+	next    http.RoundTripper
+	creds   aws.CredentialsProvider
+	signer  *signer.Signer
+
+	// now returns the signing time, it is only replaced in tests.
+	now func() time.Time
+}
+
+/*
+newSigV4RoundTripper returns a round tripper that signs requests and then hands them off to next.
+If next is nil, http.DefaultTransport will be used.
+Credentials are resolved from the configured keys, profile or the default AWS credentials chain, in this order.
+*/
+func newSigV4RoundTripper(cfg *SigV4, next http.RoundTripper) (*sigV4RoundTripper, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, config.WithRegion(cfg.Region))
+	}
+	if cfg.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(cfg.Profile))
+	}
+	if cfg.AccessKey != "" || cfg.SecretKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKey, string(cfg.SecretKey), "")))
+	}
+
+	ctx := context.Background()
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load AWS config: %v", err)
+	}
+	if _, err := awsCfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, fmt.Errorf("could not get sigv4 credentials: %v", err)
+	}
+	if awsCfg.Region == "" {
+		return nil, fmt.Errorf("region not configured in sigv4 or in default credentials chain")
+	}
+
+	creds := awsCfg.Credentials
+	if cfg.RoleARN != "" {
+		creds = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.RoleARN))
+	}
+
+	service := cfg.Service
+	if service == "" {
+		service = "execute-api"
+	}
+
+	return &sigV4RoundTripper{
+		region:  awsCfg.Region,
+		service: service,
+		next:    next,
+		creds:   creds,
+		signer:  signer.NewSigner(),
+		now:     time.Now,
+	}, nil
+}
+
+func (rt *sigV4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the payload is hashed for the signature, so buffer the original body.
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	payloadHash := sha256.Sum256(body)
+
+	creds, err := rt.creds.Retrieve(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("could not get sigv4 credentials: %v", err)
+	}
+
+	// Clone the request and trim out headers that we don't want to sign.
+	signReq := req.Clone(req.Context())
+	for _, header := range sigv4HeaderDenylist {
+		signReq.Header.Del(header)
+	}
+	if err := rt.signer.SignHTTP(req.Context(), creds, signReq, hex.EncodeToString(payloadHash[:]), rt.service, rt.region, rt.now().UTC()); err != nil {
+		return nil, fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	// Copy over the headers set by the signer.
+	sendReq := req.Clone(req.Context())
+	for _, header := range sigv4SignedHeaders {
+		if v := signReq.Header.Get(header); v != "" {
+			sendReq.Header.Set(header, v)
+		}
+	}
+	sendReq.Body = io.NopCloser(bytes.NewReader(body))
+	sendReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return rt.next.RoundTrip(sendReq)
+}
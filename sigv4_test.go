@@ -0,0 +1,95 @@
+package caddy_logger_loki
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingRoundTripper records the request it receives instead of sending it.
+type recordingRoundTripper struct {
+	req  *http.Request
+	body string
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	rt.req = req
+	rt.body = string(body)
+	return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+}
+
+func TestSigV4RoundTripper(t *testing.T) {
+	// make sure the default credentials chain can't interfere with the static keys
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+
+	// the get-vanilla and post-vanilla cases of the AWS Signature Version 4 test suite
+	tests := []struct {
+		method        string
+		authorization string
+	}{
+		{
+			http.MethodGet,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			http.MethodPost,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	cfg := SigV4{Region: "us-east-1", AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", Service: "service"}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			next := &recordingRoundTripper{}
+			rt, err := newSigV4RoundTripper(&cfg, next)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			rt.now = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+
+			req, _ := http.NewRequest(test.method, "https://example.amazonaws.com/", nil)
+			if _, err := rt.RoundTrip(req); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := next.req.Header.Get("Authorization"); got != test.authorization {
+				t.Fatalf("expected authorization header %q, got %q", test.authorization, got)
+			}
+			if next.req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+				t.Fatalf("unexpected X-Amz-Date header %q", next.req.Header.Get("X-Amz-Date"))
+			}
+		})
+	}
+
+	t.Run("push request", func(t *testing.T) {
+		next := &recordingRoundTripper{}
+		rt, err := newSigV4RoundTripper(&SigV4{Region: "eu-west-1", AccessKey: "AKIDEXAMPLE", SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, next)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req, _ := http.NewRequest(http.MethodPost, "https://loki.example.com/loki/api/v1/push", strings.NewReader("payload"))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Scope-OrgID", "tenant")
+		req.Header.Set("Uber-Trace-Id", "trace")
+		if _, err := rt.RoundTrip(req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		authorization := next.req.Header.Get("Authorization")
+		if !strings.Contains(authorization, "/eu-west-1/execute-api/aws4_request, SignedHeaders=content-length;content-type;host;x-amz-date;x-scope-orgid,") {
+			t.Fatalf("expected the headers except uber-trace-id signed for execute-api, got %q", authorization)
+		}
+		if next.body != "payload" {
+			t.Fatalf("body was altered by signing, got %q", next.body)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Fatalf("original request must not be modified")
+		}
+	})
+}
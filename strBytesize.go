@@ -0,0 +1,93 @@
+package caddy_logger_loki
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// byteSizeRegexp matches a size, a number with an optional unit.
+var byteSizeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-z]*)$`)
+
+// Map of byte size units to multipliers, KB and MB are decimal, KiB and MiB binary
+var byteSizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1000,
+	"kb":  1000,
+	"ki":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1000 * 1000,
+	"mb":  1000 * 1000,
+	"mi":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1000 * 1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"gi":  1 << 30,
+	"gib": 1 << 30,
+}
+
+// StrByteSize is a size in bytes, written as a number of bytes or with a unit, e.g. 256kb, 2MiB.
+type StrByteSize struct {
+	Raw string
+	B   int
+}
+
+func (b *StrByteSize) FromString(raw string) error {
+	match := byteSizeRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(raw)))
+	if match == nil {
+		return errors.New("invalid byte size format, expected a number with an optional unit, get: " + raw)
+	}
+
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return errors.New("invalid byte size format, unable to parse size value, get: " + match[1])
+	}
+	multiplier, exists := byteSizeUnits[match[2]]
+	if !exists {
+		return errors.New("invalid byte size unit " + match[2] + ", valid units are: B, KB, KiB, MB, MiB, GB, GiB")
+	}
+	size := value * multiplier
+	if size > math.MaxInt {
+		return errors.New("byte size " + raw + " is too large")
+	}
+	// it would be truncated to 0, which means the default of most sizes
+	if size > 0 && size < 1 {
+		return errors.New("byte size " + raw + " is less than 1 byte")
+	}
+
+	b.Raw = raw
+	b.B = int(size)
+	return nil
+}
+
+// UnmarshalJSON accepts a number of bytes, or a string with an optional unit.
+func (b *StrByteSize) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err == nil {
+		return b.FromString(raw)
+	}
+	var size int
+	if err := json.Unmarshal(data, &size); err != nil || size < 0 {
+		return errors.New("invalid byte size, expected a number of bytes or a string, get: " + string(data))
+	}
+	// a number is marshalled back as number
+	b.Raw = ""
+	b.B = size
+	return nil
+}
+
+// MarshalJSON writes the size as it was configured, so it is read back the same.
+func (b *StrByteSize) MarshalJSON() ([]byte, error) {
+	if b.Raw == "" {
+		return json.Marshal(b.B)
+	}
+	return json.Marshal(b.Raw)
+}
+
+func (b *StrByteSize) Bytes() int {
+	return b.B
+}
@@ -0,0 +1,101 @@
+package caddy_logger_loki
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStrByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+		hasError bool
+	}{
+		{"1048576", 1048576, false},
+		{"100B", 100, false},
+		{"256kb", 256000, false},
+		{"256KiB", 256 * 1024, false},
+		{"2M", 2000000, false},
+		{"2MB", 2000000, false},
+		{"2MiB", 2 * 1024 * 1024, false},
+		{"1.5 MiB", 1536 * 1024, false},
+		{"1GB", 1000 * 1000 * 1000, false},
+		{"1GiB", 1 << 30, false},
+		{"invalid", 0, true},
+		{"5TB", 0, true}, // Invalid unit 'tb'
+		{"-1KB", 0, true},
+		{"1KB 2KB", 0, true},
+		{"0.5", 0, true},
+		{"0.9B", 0, true},
+		{"0", 0, false},
+		{"0.5KB", 500, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			sb := StrByteSize{}
+			err := sb.FromString(test.input)
+
+			if test.hasError {
+				if err == nil {
+					t.Fatalf("expected error for input %q, got nil", test.input)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error for input %q: %v", test.input, err)
+				}
+				if sb.Bytes() != test.expected {
+					t.Fatalf("for input %q, expected %v, got %v", test.input, test.expected, sb.Bytes())
+				}
+			}
+		})
+	}
+
+	// Test UnmarshalJson and the round trip of MarshalJSON
+	jsonTests := []struct {
+		input    string
+		expected int
+	}{
+		{`{"size": 1048576}`, 1048576},
+		{`{"size": "1048576"}`, 1048576},
+		{`{"size": "256kb"}`, 256000},
+		{`{"size": "2MiB"}`, 2 * 1024 * 1024},
+		{`{"size": "invalid"}`, -1}, // -1 means error
+		{`{"size": -1}`, -1},
+		{`{"size": 1.5}`, -1},
+		{`{"size": "0.5"}`, -1},
+		{`{"no_size": "1KB"}`, 0}, // No size field
+	}
+
+	for _, test := range jsonTests {
+		t.Run(test.input, func(t *testing.T) {
+			sb := struct {
+				Size StrByteSize `json:"size"`
+			}{}
+			err := json.Unmarshal([]byte(test.input), &sb)
+
+			if test.expected == -1 {
+				if err == nil {
+					t.Fatalf("expected error for input %q, got nil", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error for input %q: %v", test.input, err)
+			}
+			if sb.Size.Bytes() != test.expected {
+				t.Fatalf("for input %q, expected %v, got %v", test.input, test.expected, sb.Size.Bytes())
+			}
+
+			data, err := json.Marshal(&sb)
+			if err != nil {
+				t.Fatalf("unexpected error marshalling %q: %v", test.input, err)
+			}
+			roundTrip := sb
+			roundTrip.Size = StrByteSize{}
+			if err := json.Unmarshal(data, &roundTrip); err != nil || roundTrip.Size.Bytes() != sb.Size.Bytes() || roundTrip.Size.Raw != sb.Size.Raw {
+				t.Fatalf("expected %s to unmarshal to %+v, got %+v, %v", data, sb.Size, roundTrip.Size, err)
+			}
+		})
+	}
+}
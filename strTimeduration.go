@@ -9,17 +9,38 @@ import (
 	"time"
 )
 
+var (
+	// durationRegexp matches a whole duration of the custom syntax, e.g. 1d 12h
+	durationRegexp = regexp.MustCompile(`^(\d+\s*(ms|s|m|h|d|w)\s*)+$`)
+	// durationPartRegexp matches a part of a duration of the custom syntax
+	durationPartRegexp = regexp.MustCompile(`(\d+)\s*(ms|s|m|h|d|w)`)
+)
+
+/*
+StrTimeDuration is a duration written as Go duration, e.g. 1m30s, or with the custom units d and w, e.g. 1d12h.
+In JSON, it is also accepted as integer of nanoseconds, and written back as it was read. Negative durations are rejected.
+*/
 type StrTimeDuration struct {
 	Raw string
 	T   time.Duration
 }
 
 func (t *StrTimeDuration) FromString(raw string) error {
-	re := regexp.MustCompile(`(\d+)\s*(ms|s|m|h|d|w)`)
-	matches := re.FindAllStringSubmatch(strings.ToLower(raw), -1)
+	t.Raw = ""
+	t.T = 0
+
+	if d, err := time.ParseDuration(raw); err == nil {
+		if d < 0 {
+			return errors.New("time duration must not be negative, get: " + raw)
+		}
+		t.Raw = raw
+		t.T = d
+		return nil
+	}
 
-	if len(matches) == 0 {
-		return errors.New("invalid time duration format")
+	lower := strings.ToLower(strings.TrimSpace(raw))
+	if !durationRegexp.MatchString(lower) {
+		return errors.New("invalid time duration format, get: " + raw)
 	}
 
 	// Map of time units to time.Duration multipliers
@@ -32,7 +53,8 @@ func (t *StrTimeDuration) FromString(raw string) error {
 		"w":  7 * 24 * time.Hour, // 1 week
 	}
 
-	for _, match := range matches {
+	var d time.Duration
+	for _, match := range durationPartRegexp.FindAllStringSubmatch(lower, -1) {
 		value := match[1]
 		unit := match[2]
 
@@ -46,18 +68,39 @@ func (t *StrTimeDuration) FromString(raw string) error {
 			return errors.New("invalid time unit " + unit + ", valid units are: s, m, h, d, w")
 		}
 
-		t.T += time.Duration(v) * multiplier
+		d += time.Duration(v) * multiplier
 	}
 
+	t.Raw = raw
+	t.T = d
 	return nil
 }
 
+// UnmarshalJSON accepts a duration string, or an integer of nanoseconds.
 func (t *StrTimeDuration) UnmarshalJSON(data []byte) error {
-	return t.FromString(string(data))
+	var raw string
+	if err := json.Unmarshal(data, &raw); err == nil {
+		return t.FromString(raw)
+	}
+	var ns int64
+	if err := json.Unmarshal(data, &ns); err != nil {
+		return errors.New("invalid time duration, expected a string or an integer of nanoseconds, get: " + string(data))
+	}
+	if ns < 0 {
+		return errors.New("time duration must not be negative, get: " + string(data))
+	}
+	// an integer is marshalled back as integer
+	t.Raw = ""
+	t.T = time.Duration(ns)
+	return nil
 }
 
+// MarshalJSON writes the duration as it was configured, so it is read back the same.
 func (t *StrTimeDuration) MarshalJSON() ([]byte, error) {
-	return json.Marshal(t.T)
+	if t.Raw == "" {
+		return json.Marshal(t.T)
+	}
+	return json.Marshal(t.Raw)
 }
 
 func (t *StrTimeDuration) TimeDuration() time.Duration {
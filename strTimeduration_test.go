@@ -21,6 +21,17 @@ func TestStrTimeDuration(t *testing.T) {
 		{"invalid", 0, true},
 		{"5y", 0, true},                 // Invalid unit 'y'
 		{"2h60m", 3 * time.Hour, false}, // 60m should be parsed as 1 hour
+		{"1.5s", 1500 * time.Millisecond, false},
+		{"300us", 300 * time.Microsecond, false},
+		{"1d 12h", 36 * time.Hour, false},
+		{"5s banana", 0, true}, // Trailing garbage
+		{"banana 5s", 0, true},
+		{"5", 0, true},
+		{"", 0, true},
+		{"-5s", 0, true},
+		{"-1.5h", 0, true},
+		{"-1d", 0, true},
+		{"0s", 0, false},
 	}
 
 	for _, test := range tests {
@@ -58,6 +69,12 @@ func TestStrTimeDuration(t *testing.T) {
 		{`{"time": "5y"}`, -1},               // Invalid unit 'y'
 		{`{"time": "2h60m"}`, 3 * time.Hour}, // 60m should be parsed as 1 hour
 		{`{"no_time": "114514"}`, 0},         // No time field
+		{`{"time": 1500000000}`, 1500 * time.Millisecond},
+		{`{"time": "1m30s"}`, 90 * time.Second},
+		{`{"time": "5s banana"}`, -1},
+		{`{"time": 1.5}`, -1},
+		{`{"time": "-10s"}`, -1},
+		{`{"time": -1500000000}`, -1},
 	}
 
 	for _, test := range jsonTests {
@@ -70,9 +87,33 @@ func TestStrTimeDuration(t *testing.T) {
 			if err != nil && test.expected != -1 {
 				t.Fatalf("unexpected error for input %q: %v", test.input, err)
 			}
-			if test.expected != -1 && st.Time.TimeDuration() != test.expected {
+			if test.expected == -1 {
+				if err == nil {
+					t.Fatalf("expected error for input %q, got nil", test.input)
+				}
+				return
+			}
+			if st.Time.TimeDuration() != test.expected {
 				t.Fatalf("for input %q, expected %v, got %v", test.input, test.expected, st.Time.TimeDuration())
 			}
+
+			// MarshalJSON writes the duration back as it was read
+			data, err := json.Marshal(&st)
+			if err != nil {
+				t.Fatalf("unexpected error marshalling %q: %v", test.input, err)
+			}
+			roundTrip := st
+			roundTrip.Time = StrTimeDuration{}
+			if err := json.Unmarshal(data, &roundTrip); err != nil || roundTrip.Time != st.Time {
+				t.Fatalf("expected %s to unmarshal to %+v, got %+v, %v", data, st.Time, roundTrip.Time, err)
+			}
 		})
 	}
+
+	// FromString replaces the duration instead of adding to it
+	st := StrTimeDuration{}
+	_ = st.FromString("1h")
+	if err := st.FromString("30m"); err != nil || st.TimeDuration() != 30*time.Minute || st.Raw != "30m" {
+		t.Fatalf("expected 30m, got %+v, %v", st, err)
+	}
 }
@@ -0,0 +1,255 @@
+package caddy_logger_loki
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/prometheus/common/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+	The push transport isn't built with config.NewClientFromConfig, which has no way to tune the underlying
+tls.Config (cipher suites, certificate pinning). So it is built here instead, reusing the prometheus
+authentication round trippers.
+*/
+
+// transportConfig holds the connection level settings of the push transport.
+type transportConfig struct {
+	tlsConfig TLSConfig
+
+	// if set, all connections are dialed to this network address instead of the url host, e.g. a unix socket
+	dialNetwork string
+	dialAddress string
+
+	disableKeepAlives   bool
+	idleConnTimeout     time.Duration
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+}
+
+// newRoundTripper builds the round tripper used to push logs, cfg must have been validated before.
+func newRoundTripper(cfg config.HTTPClientConfig, transport transportConfig) (http.RoundTripper, error) {
+	tc, err := transport.tlsConfig.newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dialContext := dialer.DialContext
+	if transport.dialNetwork != "" {
+		dialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, transport.dialNetwork, transport.dialAddress)
+		}
+	}
+
+	var rt http.RoundTripper = &http.Transport{
+		Proxy:                 cfg.ProxyConfig.Proxy(),
+		ProxyConnectHeader:    cfg.ProxyConfig.GetProxyConnectHeader(),
+		DialContext:           dialContext,
+		DisableKeepAlives:     transport.disableKeepAlives,
+		IdleConnTimeout:       transport.idleConnTimeout,
+		MaxIdleConns:          transport.maxIdleConns,
+		MaxIdleConnsPerHost:   transport.maxIdleConnsPerHost,
+		MaxConnsPerHost:       transport.maxConnsPerHost,
+		TLSClientConfig:       tc,
+		DisableCompression:    true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if cfg.Authorization != nil {
+		rt = config.NewAuthorizationCredentialsRoundTripper(cfg.Authorization.Type, toSecretReader(cfg.Authorization.Credentials, cfg.Authorization.CredentialsFile), rt)
+	}
+	// config.HTTPClientConfig.Validate moves bearer_token into authorization, this is only a fallback.
+	if cfg.BearerToken != "" || cfg.BearerTokenFile != "" {
+		rt = config.NewAuthorizationCredentialsRoundTripper("Bearer", toSecretReader(cfg.BearerToken, cfg.BearerTokenFile), rt)
+	}
+	if cfg.BasicAuth != nil {
+		username := toSecretReader(config.Secret(cfg.BasicAuth.Username), cfg.BasicAuth.UsernameFile)
+		password := toSecretReader(cfg.BasicAuth.Password, cfg.BasicAuth.PasswordFile)
+		rt = config.NewBasicAuthRoundTripper(username, password, rt)
+	}
+	if cfg.OAuth2 != nil {
+		rt, err = newOAuth2RoundTripper(cfg.OAuth2, rt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rt, nil
+}
+
+/*
+parseDial parses a dial target written as <network>://<address>, e.g. unix:///run/loki.sock or tcp://10.0.0.1:3100.
+*/
+func parseDial(dial string) (network, address string, err error) {
+	u, err := url.Parse(dial)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		address = u.Path
+	case "tcp", "tcp4", "tcp6":
+		address = u.Host
+	default:
+		return "", "", fmt.Errorf("unsupported network %q, valid networks are: unix, tcp, tcp4, tcp6", u.Scheme)
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("missing address in %q", dial)
+	}
+	return u.Scheme, address, nil
+}
+
+/*
+parseUnixURL splits a push url of the form unix:///run/loki.sock:/loki/api/v1/push into the socket path and the
+http url sent over the socket. The push path may be omitted, it is completed like for http urls.
+*/
+func parseUnixURL(u *url.URL) (socket string, pushURL *url.URL, err error) {
+	socket, path, _ := strings.Cut(u.Path, ":")
+	if socket == "" {
+		return "", nil, fmt.Errorf("unix url must be in the form unix:///path/to/socket[:/loki/api/v1/push]")
+	}
+	return socket, &url.URL{Scheme: "http", Host: "localhost", Path: path, RawQuery: u.RawQuery}, nil
+}
+
+// toSecretReader returns a reader for the inline secret or the secret file, nil if none is configured.
+func toSecretReader(inline config.Secret, file string) config.SecretReader {
+	if inline != "" {
+		return config.NewInlineSecret(string(inline))
+	}
+	if file != "" {
+		return config.NewFileSecret(file)
+	}
+	return nil
+}
+
+// newOAuth2RoundTripper returns a round tripper which fetches tokens with the client credentials flow.
+func newOAuth2RoundTripper(cfg *config.OAuth2, next http.RoundTripper) (http.RoundTripper, error) {
+	clientSecret := string(cfg.ClientSecret)
+	if cfg.ClientSecretFile != "" {
+		b, err := os.ReadFile(cfg.ClientSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read oauth2 client secret file %s: %v", cfg.ClientSecretFile, err)
+		}
+		clientSecret = strings.TrimSpace(string(b))
+	}
+
+	// The token endpoint uses its own tls_config and proxy settings.
+	tc, err := config.NewTLSConfig(&cfg.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	tokenClient := &http.Client{Transport: &http.Transport{
+		Proxy:               cfg.ProxyConfig.Proxy(),
+		ProxyConnectHeader:  cfg.ProxyConfig.GetProxyConnectHeader(),
+		TLSClientConfig:     tc,
+		MaxIdleConns:        20,
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     10 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+
+	endpointParams := url.Values{}
+	for k, v := range cfg.EndpointParams {
+		endpointParams.Set(k, v)
+	}
+	credentialsConfig := &clientcredentials.Config{
+		ClientID:       cfg.ClientID,
+		ClientSecret:   clientSecret,
+		Scopes:         cfg.Scopes,
+		TokenURL:       cfg.TokenURL,
+		EndpointParams: endpointParams,
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, tokenClient)
+
+	return &oauth2.Transport{
+		Source: credentialsConfig.TokenSource(ctx),
+		Base:   next,
+	}, nil
+}
+
+// newTLSConfig builds the tls.Config described by t, loading and checking all the configured files.
+func (t TLSConfig) newTLSConfig() (*tls.Config, error) {
+	promTLSConfig := t.ToPrometheusTLSConfig()
+	tc, err := config.NewTLSConfig(&promTLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.CipherSuites) > 0 {
+		tc.CipherSuites, err = cipherSuiteIDs(t.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(t.PinnedSHA256) > 0 {
+		pins := make(map[[sha256.Size]byte]struct{}, len(t.PinnedSHA256))
+		for _, p := range t.PinnedSHA256 {
+			b, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin_sha256 %q, must be a base64 encoded SHA-256 hash", p)
+			}
+			pins[[sha256.Size]byte(b)] = struct{}{}
+		}
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPinnedSPKI(cs, pins)
+		}
+	}
+
+	return tc, nil
+}
+
+// verifyPinnedSPKI checks that any certificate of the verified chains (or of the presented chain when verification
+// is skipped) has a pinned public key, so both leaf and CA certificates can be pinned.
+func verifyPinnedSPKI(cs tls.ConnectionState, pins map[[sha256.Size]byte]struct{}) error {
+	chains := cs.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if _, ok := pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("none of the server certificates match the pinned public keys")
+}
+
+// cipherSuiteIDs maps cipher suite names as used by crypto/tls to their ids.
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,149 @@
+package caddy_logger_loki
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/prometheus/common/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	cert := server.Certificate()
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(spki[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name      string
+		tlsConfig TLSConfig
+		hasError  bool
+	}{
+		{"inline ca", TLSConfig{TLSConfig: config.TLSConfig{CA: ca}}, false},
+		{"unknown ca", TLSConfig{}, true},
+		{"pinned certificate", TLSConfig{TLSConfig: config.TLSConfig{CA: ca}, PinnedSHA256: []string{otherPin, pin}}, false},
+		{"pin mismatch", TLSConfig{TLSConfig: config.TLSConfig{CA: ca}, PinnedSHA256: []string{otherPin}}, true},
+		{"pin mismatch with insecure_skip_verify", TLSConfig{TLSConfig: config.TLSConfig{InsecureSkipVerify: true}, PinnedSHA256: []string{otherPin}}, true},
+		{"min version above server max version", TLSConfig{TLSConfig: config.TLSConfig{CA: ca, MinVersion: config.TLSVersion(tls.VersionTLS13)}}, true},
+		{"cipher suite", TLSConfig{TLSConfig: config.TLSConfig{CA: ca}, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rt, err := newRoundTripper(config.HTTPClientConfig{}, transportConfig{tlsConfig: test.tlsConfig})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			resp, err := rt.RoundTrip(req)
+			if test.hasError {
+				if err == nil {
+					t.Fatalf("expected error, got status %d", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_ = resp.Body.Close()
+		})
+	}
+
+	invalid := []TLSConfig{
+		{CipherSuites: []string{"TLS_NOT_A_CIPHER"}},
+		{PinnedSHA256: []string{"not base64"}},
+		{TLSConfig: config.TLSConfig{CAFile: "/nonexistent/ca.pem"}},
+		{TLSConfig: config.TLSConfig{CA: "not a certificate"}},
+	}
+	for _, tlsConfig := range invalid {
+		if _, err := tlsConfig.newTLSConfig(); err == nil {
+			t.Fatalf("expected error for %+v", tlsConfig)
+		}
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected uint16
+		hasError bool
+	}{
+		{"TLS13", tls.VersionTLS13, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"tls1.2", tls.VersionTLS12, false},
+		{"1.4", 0, true},
+	}
+
+	for _, test := range tests {
+		v, err := parseTLSVersion(test.input)
+		if test.hasError != (err != nil) {
+			t.Fatalf("for input %q, unexpected error state: %v", test.input, err)
+		}
+		if uint16(v) != test.expected {
+			t.Fatalf("for input %q, expected %d, got %d", test.input, test.expected, v)
+		}
+	}
+}
+
+func TestUnixSocketURL(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "loki.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	paths := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	tests := []LokiLog{
+		{Url: "unix://" + socket + ":/loki/api/v1/push"},
+		{Url: "unix://" + socket},
+		{Url: "http://loki.example.com/loki/api/v1/push", Dial: "unix://" + socket},
+	}
+	for _, l := range tests {
+		t.Run(l.Url, func(t *testing.T) {
+			l.Labels = map[string]string{"job": "caddy"}
+			pushLines(t, &l, `{"msg":"hello"}`)
+
+			select {
+			case path := <-paths:
+				if path != "/loki/api/v1/push" {
+					t.Fatalf("expected push path /loki/api/v1/push, got %q", path)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no push request received on the unix socket")
+			}
+		})
+	}
+
+	invalid := []LokiLog{
+		{Url: "unix://"},
+		{Url: "unix://" + socket + ":/loki/api/v1/push", Dial: "tcp://127.0.0.1:3100"},
+		{Url: "http://loki.example.com/loki/api/v1/push", Dial: "udp://127.0.0.1:3100"},
+	}
+	for _, l := range invalid {
+		l.Labels = map[string]string{"job": "caddy"}
+		if err := l.Validate(); err == nil {
+			t.Fatalf("expected error for url %q and dial %q", l.Url, l.Dial)
+		}
+	}
+}
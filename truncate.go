@@ -0,0 +1,116 @@
+package caddy_logger_loki
+
+import (
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+/*
+	Truncating a JSON line at a byte offset makes it invalid JSON, which LogQL's json parser rejects. In json mode,
+the largest string fields are shortened first, each ending with a marker of the bytes it lost, until the line fits.
+JSON lines which don't fit with all their strings shortened are dropped instead, lines which aren't JSON objects are
+truncated at the byte offset.
+*/
+
+const (
+	truncateModeBytes = "bytes"
+	truncateModeJSON  = "json"
+)
+
+// truncatedMarker returns the marker ending a string shortened by n bytes.
+func truncatedMarker(n int) string {
+	return "…[truncated " + strconv.Itoa(n) + " bytes]"
+}
+
+/*
+truncateLine truncates line to max bytes, keeping JSON lines valid if json is set. It returns false for JSON lines
+which don't fit with all their strings shortened.
+*/
+func truncateLine(line string, max int, json bool) (string, bool) {
+	if json {
+		if fields, err := parseFields([]byte(line)); err == nil {
+			return truncateJSON(fields, max)
+		}
+	}
+	return truncateUTF8(line, max), true
+}
+
+// truncateUTF8 truncates s to at most max bytes, without splitting a UTF-8 encoded rune.
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// stringField is a string value in the fields of a JSON line.
+type stringField struct {
+	value string
+	set   func(string)
+}
+
+/*
+truncateJSON shortens the largest string fields of a JSON line until it fits into max bytes. It returns false if it
+doesn't fit.
+*/
+func truncateJSON(fields []field, max int) (string, bool) {
+	values := collectStrings(nil, fields)
+	sort.SliceStable(values, func(i, j int) bool { return len(values[i].value) > len(values[j].value) })
+
+	encoded := appendJSON(nil, fields)
+	for _, s := range values {
+		excess := len(encoded) - max
+		if excess <= 0 {
+			break
+		}
+		// every byte cut from the string shortens the encoded line by at least a byte, as escaping only adds bytes
+		cut := excess
+		for excess+len(truncatedMarker(cut)) > cut {
+			cut = excess + len(truncatedMarker(cut))
+		}
+		if cut >= len(s.value) {
+			cut = len(s.value)
+			// the marker would make short strings longer
+			if len(truncatedMarker(cut)) >= cut {
+				continue
+			}
+		}
+		keep := len(s.value) - cut
+		for keep > 0 && !utf8.RuneStart(s.value[keep]) {
+			keep--
+		}
+		s.set(s.value[:keep] + truncatedMarker(len(s.value)-keep))
+		encoded = appendJSON(encoded[:0], fields)
+	}
+	if len(encoded) > max {
+		return "", false
+	}
+	return string(encoded), true
+}
+
+// collectStrings appends the string values nested in value to values.
+func collectStrings(values []stringField, value any) []stringField {
+	switch v := value.(type) {
+	case []field:
+		for i := range v {
+			if s, ok := v[i].value.(string); ok {
+				values = append(values, stringField{value: s, set: func(s string) { v[i].value = s }})
+				continue
+			}
+			values = collectStrings(values, v[i].value)
+		}
+	case []any:
+		for i := range v {
+			if s, ok := v[i].(string); ok {
+				values = append(values, stringField{value: s, set: func(s string) { v[i] = s }})
+				continue
+			}
+			values = collectStrings(values, v[i])
+		}
+	}
+	return values
+}
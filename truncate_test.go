@@ -0,0 +1,94 @@
+package caddy_logger_loki
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTruncateLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		max      int
+		json     bool
+		expected string
+		// whether the truncated line is valid JSON
+		valid bool
+		// whether the line is dropped
+		dropped bool
+	}{
+		{
+			name:     "bytes",
+			line:     `{"msg":"handled request"}`,
+			max:      10,
+			expected: `{"msg":"ha`,
+		},
+		{
+			name:     "largest string first",
+			line:     `{"level":"info","msg":"` + strings.Repeat("a", 100) + `","uri":"/index.html"}`,
+			max:      80,
+			json:     true,
+			expected: `{"level":"info","msg":"` + strings.Repeat("a", 12) + `…[truncated 88 bytes]","uri":"/index.html"}`,
+			valid:    true,
+		},
+		{
+			name:     "several strings",
+			line:     `{"a":"` + strings.Repeat("a", 40) + `","b":["` + strings.Repeat("b", 40) + `"],"n":1}`,
+			max:      75,
+			json:     true,
+			expected: `{"a":"…[truncated 40 bytes]","b":["` + strings.Repeat("b", 6) + `…[truncated 34 bytes]"],"n":1}`,
+			valid:    true,
+		},
+		{
+			name:     "utf-8",
+			line:     `{"msg":"` + strings.Repeat("é", 20) + `"}`,
+			max:      40,
+			json:     true,
+			expected: `{"msg":"ééé…[truncated 34 bytes]"}`,
+			valid:    true,
+		},
+		{
+			name:     "not json",
+			line:     "2024/08/01 12:00:00 console log",
+			max:      10,
+			json:     true,
+			expected: "2024/08/01",
+		},
+		{
+			name:     "bytes utf-8",
+			line:     "2024/08/01 größe",
+			max:      14,
+			json:     true,
+			expected: "2024/08/01 gr",
+		},
+		{
+			name:    "not fitting",
+			line:    `{"msg":"` + strings.Repeat("a", 40) + `","status":200}`,
+			max:     20,
+			json:    true,
+			dropped: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			truncated, ok := truncateLine(test.line, test.max, test.json)
+			if ok == test.dropped {
+				t.Fatalf("expected dropped to be %v, got %v", test.dropped, !ok)
+			}
+			if test.dropped {
+				return
+			}
+			if truncated != test.expected {
+				t.Fatalf("expected %s, got %s", test.expected, truncated)
+			}
+			if len(truncated) > test.max {
+				t.Fatalf("expected at most %d bytes, got %d", test.max, len(truncated))
+			}
+			if json.Valid([]byte(truncated)) != test.valid {
+				t.Fatalf("expected valid JSON to be %v, got %s", test.valid, truncated)
+			}
+		})
+	}
+}
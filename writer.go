@@ -1,48 +1,240 @@
 package caddy_logger_loki
 
 import (
-	"github.com/grafana/loki/v3/clients/pkg/promtail/api"
-	"github.com/grafana/loki/v3/clients/pkg/promtail/client"
-	"github.com/grafana/loki/v3/pkg/logproto"
+	"bytes"
+	"errors"
+	"github.com/grafana/loki/pkg/push"
 	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// errWriterClosed is returned by writes to a closed writer.
+var errWriterClosed = errors.New("loki writer is closed")
+
+// writerState is the lifecycle of a writer.
+type writerState int
+
+const (
+	// entries are pushed
+	writerOpen writerState = iota
+	// Close sends the pending entries, writes go to the fallback writer or fail
+	writerDraining
+	// writes fail
+	writerClosed
+)
+
+/*
+LokiWriter pushes the lines written to it. Caddy may still write to it after Close, from a lagging goroutine during a
+config reload, so writes are guarded by its state instead of reaching the stopped client.
+*/
 type LokiWriter struct {
-	client client.Client
+	client *client
 	logger logger
-	send   chan<- api.Entry
-	lbs    model.LabelSet
+	// shared by all the entries of the writer, so they are never modified
+	lbs model.LabelSet
+	// lbs formatted by labelsString
+	stream string
+	// joins lines into multiline entries, nil without multiline mode
+	multiline *multiline
+	// rewrites lines into the line format, nil for raw lines
+	format *lineFormatter
+
+	/*
+		held for reading by writes while they hand entries to the client, and for writing to wait for them. The state
+		is changed atomically, so Close doesn't wait for writes blocked on a full queue before the client is aborted.
+	*/
+	mu    sync.RWMutex
+	state atomic.Int32
+
+	// closed on Close, to stop replaying
+	closing chan struct{}
+	// guards starting a replay against Close, separate from mu as replays start from the workers of the client
+	replayMu  sync.Mutex
+	replaying sync.WaitGroup
 }
 
-func newLokiWriter(client client.Client, logger logger, labels map[string]string) *LokiWriter {
+func newLokiWriter(client *client, logger logger, labels map[string]string, multiline *Multiline, format *lineFormatter) *LokiWriter {
 	lbs := model.LabelSet{}
 	for k, v := range labels {
 		lbs[model.LabelName(k)] = model.LabelValue(v)
 	}
 
-	return &LokiWriter{
-		client: client,
-		logger: logger,
-		send:   client.Chan(),
-		lbs:    lbs,
+	w := &LokiWriter{
+		client:  client,
+		logger:  logger,
+		lbs:     lbs,
+		stream:  labelsString(lbs),
+		format:  format,
+		closing: make(chan struct{}),
+	}
+	if multiline != nil {
+		w.multiline = newMultiline(multiline, w.handle)
 	}
+	if b := client.cfg.Breaker; b != nil && b.replayFile != "" {
+		b.onClose = w.replay
+	}
+	return w
 }
 
 func (w *LokiWriter) Write(p []byte) (n int, err error) {
-	entry := api.Entry{
-		Labels: w.lbs.Clone(),
-		Entry: logproto.Entry{
-			Timestamp: time.Now(),
-			Line:      string(p),
-		},
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	switch writerState(w.state.Load()) {
+	case writerDraining:
+		// the fallback writer is closed after draining
+		if b := w.client.cfg.Breaker; b != nil {
+			if err := b.writeFallback(p); err != nil {
+				return 0, err
+			}
+			w.client.metrics.fallbackEntries.WithLabelValues(w.client.cfg.URL.Host).Add(float64(countLines(p)))
+			return len(p), nil
+		}
+		return 0, errWriterClosed
+	case writerClosed:
+		return 0, errWriterClosed
+	}
+
+	// write to the fallback writer while the server is unreachable, the lines are formatted when they are replayed
+	if b := w.client.cfg.Breaker; b != nil && b.isOpen() {
+		if ok, err := b.write(p); ok {
+			w.client.metrics.fallbackEntries.WithLabelValues(w.client.cfg.URL.Host).Add(float64(countLines(p)))
+			return len(p), err
+		}
 	}
-	w.send <- entry
 
+	// a write may hold several lines, each is an entry of its own
+	now := time.Now()
+	for rest := p; len(rest) > 0; {
+		var line []byte
+		line, rest = nextLine(rest)
+		if len(line) == 0 {
+			continue
+		}
+		if w.format != nil {
+			line = w.format.formatLine(line)
+		}
+		if w.multiline != nil {
+			w.multiline.add(string(line), now)
+			continue
+		}
+		// the line is copied by the client, so writes allocate nothing for it
+		w.client.handleLine(w.entry(now), line)
+	}
 	return len(p), nil
 }
 
+// countLines returns the number of lines of p which aren't empty, each is an entry of its own.
+func countLines(p []byte) int {
+	n := 0
+	for rest := p; len(rest) > 0; {
+		var line []byte
+		line, rest = nextLine(rest)
+		if len(line) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// nextLine returns the first line of p, without line ending, and the rest of p after it.
+func nextLine(p []byte) (line, rest []byte) {
+	line = p
+	if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		line, rest = p[:i], p[i+1:]
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), rest
+}
+
+// entry returns an entry of the writer with timestamp ts and without line.
+func (w *LokiWriter) entry(ts time.Time) entry {
+	return entry{
+		labels: w.lbs,
+		stream: w.stream,
+		Entry:  push.Entry{Timestamp: ts},
+	}
+}
+
+func (w *LokiWriter) handle(line string, ts time.Time) {
+	e := w.entry(ts)
+	e.Line = line
+	w.client.handle(e)
+}
+
+// replay pushes the lines written to the fallback file after offset, in the background.
+func (w *LokiWriter) replay(offset int64) {
+	file := w.client.cfg.Breaker.replayFile
+	// Close waits for the replay, so it must not start once the writer is closing
+	w.replayMu.Lock()
+	defer w.replayMu.Unlock()
+	select {
+	case <-w.closing:
+		return
+	default:
+	}
+	w.replaying.Add(1)
+	go func() {
+		defer w.replaying.Done()
+		lines, err := replayLines(file, offset, w.closing, w.replayLine)
+		if err != nil {
+			w.logger.logger.Error("error replaying the fallback file", zap.String("file", file), zap.Error(err))
+		}
+		w.logger.logger.Info("replayed the fallback file", zap.String("file", file), zap.Int("lines", lines))
+	}()
+}
+
+/*
+replayLine pushes a line of the fallback file. Lines of failed batches are pushed as they were sent, the lines written
+during the outage are pushed in the line format, with the timestamp of their ts field.
+*/
+func (w *LokiWriter) replayLine(line string, offset int64) {
+	if ts, ok := w.client.cfg.Breaker.sentAt(offset); ok {
+		w.handle(line, ts)
+		return
+	}
+	ts := lineTimestamp(line)
+	if w.format != nil {
+		line = string(w.format.formatLine([]byte(line)))
+	}
+	w.handle(line, ts)
+}
+
+/*
+Close sends the pending entries and stops the writer. Writes during Close go to the fallback writer, if configured,
+writes after Close fail. Closing a closed writer does nothing.
+*/
 func (w *LokiWriter) Close() error {
+	if !w.state.CompareAndSwap(int32(writerOpen), int32(writerDraining)) {
+		return nil
+	}
+	// stop retrying first, writes waiting for a full queue would otherwise block Close until the retries are exhausted
+	w.client.abort()
+	// wait for the writes handing entries to the client
+	w.mu.Lock()
+	w.mu.Unlock()
+
+	w.replayMu.Lock()
+	close(w.closing)
+	w.replayMu.Unlock()
+	w.replaying.Wait()
+	if w.multiline != nil {
+		w.multiline.close()
+	}
 	w.client.StopNow()
-	return nil
+
+	// wait for the writes to the fallback writer, before closing it
+	w.mu.Lock()
+	w.state.Store(int32(writerClosed))
+	w.mu.Unlock()
+
+	var errs []error
+	if b := w.client.cfg.Breaker; b != nil {
+		errs = append(errs, b.fallback.Close())
+	}
+	if d := w.client.cfg.DeadLetter; d != nil {
+		errs = append(errs, d.Close())
+	}
+	return errors.Join(errs...)
 }
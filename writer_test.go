@@ -0,0 +1,309 @@
+package caddy_logger_loki
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNextLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		p        string
+		expected []string
+	}{
+		{"trailing newline", "{\"msg\":\"handled request\"}\n", []string{`{"msg":"handled request"}`}},
+		{"no newline", "handled request", []string{"handled request"}},
+		{"several lines", "first\nsecond\n", []string{"first", "second"}},
+		{"crlf", "first\r\nsecond\r\n", []string{"first", "second"}},
+		{"empty lines", "\nfirst\n\n\nsecond", []string{"first", "second"}},
+		{"only newlines", "\n\n", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lines []string
+			for rest := []byte(test.p); len(rest) > 0; {
+				var line []byte
+				line, rest = nextLine(rest)
+				if len(line) > 0 {
+					lines = append(lines, string(line))
+				}
+			}
+			if strings.Join(lines, "|") != strings.Join(test.expected, "|") || len(lines) != len(test.expected) {
+				t.Fatalf("expected %q, got %q", test.expected, lines)
+			}
+		})
+	}
+}
+
+func TestWriterSplitsLines(t *testing.T) {
+	s := &testServer{}
+	c, _ := newTestClient(t, s, clientConfig{})
+	w := newLokiWriter(c, c.logger, map[string]string{"job": "caddy"}, nil, nil)
+	_, _ = w.Write([]byte("first\n"))
+	_, _ = w.Write([]byte("second\nthird\n"))
+	_ = w.Close()
+
+	entries := s.entries()
+	if len(entries) != 1 || strings.Join(entries[0], "|") != "first|second|third" {
+		t.Fatalf("expected the entries first, second and third, got %q", entries)
+	}
+}
+
+// multilineRecorder records the entries of a multiline.
+type multilineRecorder struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (r *multilineRecorder) handle(line string, _ time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, line)
+}
+
+func (r *multilineRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.entries...)
+}
+
+func TestMultiline(t *testing.T) {
+	cfg := &Multiline{
+		MaxWait:      StrTimeDuration{T: time.Hour},
+		MaxLines:     3,
+		startPattern: regexp.MustCompile(`^\d{4}/\d{2}/\d{2}`),
+	}
+	tests := []struct {
+		name     string
+		lines    []string
+		expected []string
+	}{
+		{
+			name:     "stack trace",
+			lines:    []string{"2024/08/01 panic: boom", "goroutine 1 [running]:", "main.main()", "2024/08/01 recovered"},
+			expected: []string{"2024/08/01 panic: boom\ngoroutine 1 [running]:\nmain.main()", "2024/08/01 recovered"},
+		},
+		{
+			name:     "no start line first",
+			lines:    []string{"continued", "2024/08/01 started"},
+			expected: []string{"continued", "2024/08/01 started"},
+		},
+		{
+			name:     "max lines",
+			lines:    []string{"2024/08/01 start", "1", "2", "3", "4"},
+			expected: []string{"2024/08/01 start\n1\n2", "3\n4"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &multilineRecorder{}
+			m := newMultiline(cfg, r.handle)
+			for _, line := range test.lines {
+				m.add(line, time.Now())
+			}
+			// close sends the pending entry
+			m.close()
+			entries := r.get()
+			if strings.Join(entries, "|") != strings.Join(test.expected, "|") {
+				t.Fatalf("expected %q, got %q", test.expected, entries)
+			}
+		})
+	}
+}
+
+func TestMultilineMaxWait(t *testing.T) {
+	r := &multilineRecorder{}
+	m := newMultiline(&Multiline{
+		MaxWait:      StrTimeDuration{T: 20 * time.Millisecond},
+		MaxLines:     128,
+		startPattern: regexp.MustCompile(`^start`),
+	}, r.handle)
+	defer m.close()
+
+	first := time.Now()
+	m.add("start", first)
+	time.Sleep(10 * time.Millisecond)
+	m.add("continued", time.Now())
+	if entries := r.get(); len(entries) != 0 {
+		t.Fatalf("expected no entry before max_wait, got %q", entries)
+	}
+
+	waitFor(t, func() bool { return len(r.get()) == 1 })
+	if entries := r.get(); entries[0] != "start\ncontinued" {
+		t.Fatalf("expected the joined entry, got %q", entries)
+	}
+}
+
+func TestWriterWriteAfterClose(t *testing.T) {
+	s := &testServer{}
+	c, _ := newTestClient(t, s, clientConfig{})
+	w := newLokiWriter(c, c.logger, map[string]string{"job": "caddy"}, nil, nil)
+	if _, err := w.Write([]byte("before\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected closing twice to do nothing, got %v", err)
+	}
+
+	if n, err := w.Write([]byte("after\n")); n != 0 || !errors.Is(err, errWriterClosed) {
+		t.Fatalf("expected errWriterClosed, got %d, %v", n, err)
+	}
+	if entries := s.entries(); len(entries) != 1 || strings.Join(entries[0], "|") != "before" {
+		t.Fatalf("expected only the entry written before Close, got %q", entries)
+	}
+}
+
+func TestWriterDrainingToFallback(t *testing.T) {
+	s := &testServer{}
+	f := fallbackFile(t)
+	b := newBreaker(&Fallback{}, f, newLogger(zap.NewNop()))
+	c, m := newTestClient(t, s, clientConfig{Breaker: b})
+	w := newLokiWriter(c, c.logger, map[string]string{"job": "caddy"}, nil, nil)
+
+	w.state.Store(int32(writerDraining))
+	if _, err := w.Write([]byte("draining\nsecond\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fallback := counterValue(t, m.fallbackEntries.WithLabelValues(c.cfg.URL.Host)); fallback != 2 {
+		t.Fatalf("expected the 2 lines of the write in the fallback writer, got %v", fallback)
+	}
+	content, _ := os.ReadFile(f.Name())
+	if string(content) != "draining\nsecond\n" {
+		t.Fatalf("unexpected fallback file: %q", content)
+	}
+	w.state.Store(int32(writerOpen))
+	_ = w.Close()
+}
+
+// TestWriterCloseFullQueue closes the writer while the worker retries a failing server and writes wait for the full queue.
+func TestWriterCloseFullQueue(t *testing.T) {
+	s := &testServer{respond: func(receivedPush) (int, string) { return http.StatusServiceUnavailable, "unavailable" }}
+	c, m := newTestClient(t, s, clientConfig{
+		BatchSize:     1000,
+		BackoffConfig: backoffConfig{MinBackoff: time.Hour, MaxBackoff: time.Hour},
+	})
+	w := newLokiWriter(c, c.logger, map[string]string{"job": "caddy"}, nil, nil)
+
+	// the worker retries the first batch, the following lines fill the queue until the writes wait
+	written := make(chan int)
+	go func() {
+		n := 0
+		for {
+			if _, err := w.Write([]byte("line\n")); err != nil {
+				written <- n
+				return
+			}
+			n++
+		}
+	}()
+	waitFor(t, func() bool {
+		if counterValue(t, m.batchRetries.WithLabelValues(c.cfg.URL.Host, "")) == 0 {
+			return false
+		}
+		q := c.queues[0]
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.entries) == maxQueuedEntries
+	})
+
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close is blocked by the retries")
+	}
+	n := <-written
+
+	// the batches are sent once without retries, the write waiting for the queue is dropped as well
+	if dropped := counterValue(t, m.droppedEntries.WithLabelValues(c.cfg.URL.Host, "", reasonGeneric)); dropped != float64(n) {
+		t.Fatalf("expected all %d entries to be dropped, got %v", n, dropped)
+	}
+}
+
+// TestWriterConcurrentWriteClose writes while the writer is closed, as Caddy does during a config reload, run with -race.
+func TestWriterConcurrentWriteClose(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			s := &testServer{}
+			c, m := newTestClient(t, s, clientConfig{BatchWait: time.Millisecond, Workers: workers})
+			w := newLokiWriter(c, c.logger, map[string]string{"job": "caddy"}, &Multiline{
+				MaxWait:      StrTimeDuration{T: time.Millisecond},
+				MaxLines:     2,
+				startPattern: regexp.MustCompile(`^start`),
+			}, nil)
+
+			var written, failed atomic.Int64
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 200; j++ {
+						if _, err := w.Write([]byte("start\n")); err != nil {
+							if !errors.Is(err, errWriterClosed) {
+								t.Errorf("unexpected error: %v", err)
+							}
+							failed.Add(1)
+							continue
+						}
+						written.Add(1)
+					}
+				}()
+			}
+			time.Sleep(time.Millisecond)
+			if err := w.Close(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			wg.Wait()
+
+			if written.Load()+failed.Load() != 8*200 {
+				t.Fatalf("expected every write to succeed or fail, got %d and %d", written.Load(), failed.Load())
+			}
+			if sent := counterValue(t, m.sentEntries.WithLabelValues(c.cfg.URL.Host)); sent != float64(written.Load()) {
+				t.Fatalf("expected the %d written entries to be sent, got %v", written.Load(), sent)
+			}
+		})
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	line := []byte(`{"level":"info","ts":1722513600.123,"logger":"http.log.access","msg":"handled request","request":{"method":"GET","uri":"/"},"status":200}` + "\n")
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			// the server discards the requests, so only the allocations of the writer and the client are counted
+			s := &testServer{discard: true}
+			c, _ := newTestClient(b, s, clientConfig{BatchWait: time.Second, Workers: workers})
+			w := newLokiWriter(c, c.logger, map[string]string{"job": "caddy", "host": "example.com"}, nil, nil)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(line)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := w.Write(line); err != nil {
+						b.Errorf("unexpected error: %v", err)
+					}
+				}
+			})
+			b.StopTimer()
+			_ = w.Close()
+		})
+	}
+}